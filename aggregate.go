@@ -0,0 +1,363 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ExtStat counts the files with a certain extension
+type ExtStat struct {
+	Files int64 `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Aggregate of a directory subtree
+type Aggregate struct {
+	Size   int64               `json:"size"`
+	Files  int64               `json:"files"`
+	Dirs   int64               `json:"dirs"`
+	Newest int64               `json:"newest"`
+	Exts   map[string]*ExtStat `json:"exts"`
+
+	// Set if the entries of some directories in the subtree have not been read yet
+	Partial bool `json:"partial,omitempty"`
+}
+
+func newAggregate() *Aggregate {
+	return &Aggregate{Exts: make(map[string]*ExtStat)}
+}
+
+// add a direct entry
+func (a *Aggregate) add(name string, dir bool, size int64, mtime int64) {
+	if mtime > a.Newest {
+		a.Newest = mtime
+	}
+	if dir {
+		a.Dirs++
+		return
+	}
+
+	a.Files++
+	a.Size += size
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	e := a.Exts[ext]
+	if e == nil {
+		e = &ExtStat{}
+		a.Exts[ext] = e
+	}
+	e.Files++
+	e.Size += size
+}
+
+// merge the aggregate of a subdirectory
+func (a *Aggregate) merge(b *Aggregate) {
+	a.Size += b.Size
+	a.Files += b.Files
+	a.Dirs += b.Dirs
+	if b.Newest > a.Newest {
+		a.Newest = b.Newest
+	}
+	a.Partial = a.Partial || b.Partial
+	for k, v := range b.Exts {
+		e := a.Exts[k]
+		if e == nil {
+			e = &ExtStat{}
+			a.Exts[k] = e
+		}
+		e.Files += v.Files
+		e.Size += v.Size
+	}
+}
+
+// Aggregate columns of the dirs table
+const aggCols = "size, nfiles, ndirs, newest, exts, partial"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryer is a database or transaction to read from
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// scanAggregate scans the aggregate columns of a dirs row (see aggCols), followed by extra
+func scanAggregate(row rowScanner, extra ...interface{}) (*Aggregate, error) {
+	var size, files, dirs, newest sql.NullInt64
+	var exts sql.NullString
+	var partial sql.NullBool
+	if err := row.Scan(append([]interface{}{&size, &files, &dirs, &newest, &exts, &partial}, extra...)...); err != nil {
+		return nil, err
+	}
+
+	a := newAggregate()
+	a.Size = size.Int64
+	a.Files = files.Int64
+	a.Dirs = dirs.Int64
+	a.Newest = newest.Int64
+	a.Partial = partial.Bool
+	if exts.Valid {
+		if err := json.Unmarshal([]byte(exts.String), &a.Exts); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func storeAggregate(tx *sql.Tx, where string, arg interface{}, a *Aggregate) error {
+	exts, err := json.Marshal(a.Exts)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE dirs SET size = ?, nfiles = ?, ndirs = ?, newest = ?, exts = ?, partial = ? WHERE "+where, a.Size, a.Files, a.Dirs, a.Newest, exts, a.Partial, arg)
+	return err
+}
+
+// parentDir returns the parent of directory p, or "" for the root
+func parentDir(p string) string {
+	if p == "/" {
+		return ""
+	}
+	return cleanPath(path.Dir(strings.TrimSuffix(p, "/")))
+}
+
+// rollup computes the aggregates of every directory in subtree sub, bottom-up
+func rollup(tx *sql.Tx, sub string) error {
+	glob := escapeGlob(sub) + "*"
+
+	rows, err := tx.Query("SELECT rowid, path, scanned FROM dirs WHERE path GLOB ?", glob)
+	if err != nil {
+		return err
+	}
+
+	ids := map[string]int64{}
+	aggs := map[string]*Aggregate{}
+	for rows.Next() {
+		var id, scanned int64
+		var p string
+		if err := rows.Scan(&id, &p, &scanned); err != nil {
+			rows.Close()
+			return err
+		}
+		ids[p] = id
+		aggs[p] = newAggregate()
+		aggs[p].Partial = scanned == 0
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = tx.Query("SELECT dirs.path, files.name, files.dir, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE dirs.path GLOB ?", glob)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var root, name string
+		var dir bool
+		var size, mtime sql.NullInt64
+		if err := rows.Scan(&root, &name, &dir, &size, &mtime); err != nil {
+			rows.Close()
+			return err
+		}
+		aggs[root].add(name, dir, size.Int64, mtime.Int64)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Deepest directories first, so every subdirectory is complete before it is merged into its parent
+	paths := make([]string, 0, len(aggs))
+	for p := range aggs {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") > strings.Count(paths[j], "/")
+	})
+
+	for _, p := range paths {
+		if p != sub {
+			if a := aggs[parentDir(p)]; a != nil {
+				a.merge(aggs[p])
+			}
+		}
+		if err := storeAggregate(tx, "rowid = ?", ids[p], aggs[p]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recompute the aggregate of directory p from its direct entries and the aggregates of its subdirectories
+func recompute(tx *sql.Tx, p string) error {
+	a := newAggregate()
+
+	var scanned int64
+	if err := tx.QueryRow("SELECT scanned FROM dirs WHERE path = ?", p).Scan(&scanned); err != nil {
+		return err
+	}
+	a.Partial = scanned == 0
+
+	rows, err := tx.Query("SELECT files.name, files.dir, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE dirs.path = ?", p)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		var dir bool
+		var size, mtime sql.NullInt64
+		if err := rows.Scan(&name, &dir, &size, &mtime); err != nil {
+			rows.Close()
+			return err
+		}
+		a.add(name, dir, size.Int64, mtime.Int64)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	glob := escapeGlob(p)
+	rows, err = tx.Query("SELECT "+aggCols+" FROM dirs WHERE path GLOB ? AND path NOT GLOB ?", glob+"*/", glob+"*/*/")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		s, err := scanAggregate(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		a.merge(s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	return storeAggregate(tx, "path = ?", p, a)
+}
+
+// aggregate updates the aggregates after the entries of directory p (or its whole subtree if full is set) changed
+func aggregate(tx *sql.Tx, p string, full bool) error {
+	var err error
+	if full {
+		err = rollup(tx, p)
+	} else {
+		err = recompute(tx, p)
+	}
+
+	for p = parentDir(p); p != "" && err == nil; p = parentDir(p) {
+		err = recompute(tx, p)
+	}
+	return err
+}
+
+// attachAggregates adds the aggregates of the directories in listing f (relative to dir)
+func (fs *CachedFS) attachAggregates(ctx context.Context, dir string, f Files) error {
+	if !fs.DBReady() {
+		return nil
+	}
+
+	st, err := fs.db.PrepareContext(ctx, "SELECT "+aggCols+" FROM dirs WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for i := range f {
+		if f[i].Type != "d" || f[i].Gone {
+			continue
+		}
+
+		a, err := scanAggregate(st.QueryRowContext(ctx, dir+f[i].Name+"/"))
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		f[i].Aggregate = a
+	}
+
+	return nil
+}
+
+// Usage of a directory
+type Usage struct {
+	Name string `json:"name"`
+	*Aggregate
+}
+
+// serveUsage serves the aggregates of the directories in a subtree (up to depth levels deep), largest first
+func (fs *CachedFS) serveUsage(w http.ResponseWriter, r *http.Request) {
+	if !fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	depth := 1
+	if s := r.URL.Query().Get("depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	dir := cleanPath(r.URL.Path)
+	trim := len(dir)
+
+	rows, err := fs.db.QueryContext(ctx, "SELECT "+aggCols+", path FROM dirs WHERE path GLOB ? AND LENGTH(path) - LENGTH(REPLACE(path, '/', '')) <= ? ORDER BY size DESC LIMIT 1000", escapeGlob(dir)+"*", strings.Count(dir, "/")+depth)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	defer rows.Close()
+
+	resp := make([]Usage, 0)
+	for rows.Next() {
+		var p string
+		a, err := scanAggregate(rows, &p)
+		if err != nil {
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+
+		u := Usage{Name: strings.TrimSuffix(p[trim:], "/"), Aggregate: a}
+		if u.Name == "" {
+			u.Name = "."
+		}
+		resp = append(resp, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	if len(resp) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	json.NewEncoder(w).Encode(resp)
+}
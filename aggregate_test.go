@@ -0,0 +1,47 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAggregate(t *testing.T) {
+	fs, root := newTestFS(t, "a/b/")
+	for name, size := range map[string]int{"x.iso": 100, "a/y.ISO": 10, "a/b/z.txt": 1} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fill(t, fs)
+
+	check := func(p string, size int64, files int64, dirs int64, iso int64) {
+		t.Helper()
+		a, err := scanAggregate(fs.db.QueryRow("SELECT "+aggCols+" FROM dirs WHERE path = ?", p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Size != size || a.Files != files || a.Dirs != dirs || a.Exts["iso"] == nil || a.Exts["iso"].Files != iso {
+			t.Errorf("%s: Unexpected aggregate %+v\n", p, a)
+		}
+	}
+
+	check("/", 111, 3, 2, 2)
+	check("/a/", 11, 2, 1, 1)
+
+	if err := os.WriteFile(filepath.Join(root, "a", "b", "w.iso"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FillPath("/a/b/"); err != nil {
+		t.Fatal(err)
+	}
+
+	check("/a/b/", 1001, 2, 0, 1)
+	check("/a/", 1011, 3, 1, 2)
+	check("/", 1111, 4, 2, 3)
+}
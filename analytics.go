@@ -0,0 +1,435 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between writes of recorded searches and downloads to the database
+const analyticsFlush = 10 * time.Second
+
+// Maximum number of records kept in memory until they are written, later records are dropped
+const analyticsBuffer = 10000
+
+// Downloads are attributed to a search of the same client within this period
+const analyticsSession = time.Hour
+
+// Default and maximum number of queries per report
+const (
+	reportDefault = 20
+	reportMax     = 1000
+)
+
+// SearchEvent describes a search that was served
+type SearchEvent struct {
+	Time    time.Time
+	Query   string
+	Mode    string
+	Dir     string
+	Results int64
+	Latency time.Duration
+	Client  string
+}
+
+// OnSearch registers a callback that is invoked for every search that is served
+func (fs *CachedFS) OnSearch(f func(e *SearchEvent)) {
+	fs.lmu.Lock()
+	fs.slisteners = append(fs.slisteners, f)
+	fs.lmu.Unlock()
+}
+
+// searched notifies the search listeners of a search (that started at start) for request r
+func (fs *CachedFS) searched(r *http.Request, start time.Time, dir string, results int64) {
+	fs.lmu.RLock()
+	defer fs.lmu.RUnlock()
+	if len(fs.slisteners) == 0 {
+		return
+	}
+
+	h, _, _ := net.SplitHostPort(r.RemoteAddr)
+	e := SearchEvent{
+		Time:    start,
+		Query:   r.URL.Query().Get("q"),
+		Mode:    r.URL.Query().Get("mode"),
+		Dir:     dir,
+		Results: results,
+		Latency: time.Since(start),
+		Client:  h,
+	}
+	for _, f := range fs.slisteners {
+		f(&e)
+	}
+}
+
+// normQuery returns query q with its case, diacritics and spacing normalized, for grouping
+func normQuery(q string) string {
+	return fold(strings.Join(strings.Fields(q), " "))
+}
+
+// anonymizeIP removes the host part of address ip, keeping a /24 (IPv4) or /48 (IPv6) network
+func anonymizeIP(ip string) string {
+	a := net.ParseIP(ip)
+	if a == nil {
+		return ""
+	}
+	if v4 := a.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return a.Mask(net.CIDRMask(48, 128)).String()
+}
+
+type clickRecord struct {
+	time   time.Time
+	norm   string
+	path   string
+	client string
+}
+
+// Analytics records the searches of fs and the downloads that follow them, and reports on them
+type Analytics struct {
+	fs       *CachedFS
+	mut      sync.Mutex
+	searches []SearchEvent
+	clicks   []clickRecord
+
+	// Discard records older than Retention
+	Retention time.Duration
+
+	// Only keep the network of client addresses
+	Anonymize bool
+}
+
+// NewAnalytics recording the searches of fs
+func NewAnalytics(fs *CachedFS) (*Analytics, error) {
+	if _, err := fs.db.Exec(`
+		CREATE TABLE IF NOT EXISTS searches (time INTEGER, query TEXT, norm TEXT, mode TEXT, dir TEXT, results INTEGER, latency INTEGER, client TEXT);
+		CREATE INDEX IF NOT EXISTS idx_searches_time ON searches (time);
+		CREATE INDEX IF NOT EXISTS idx_searches_norm ON searches (norm);
+		CREATE TABLE IF NOT EXISTS clicks (time INTEGER, search INTEGER, norm TEXT, path TEXT);
+		CREATE INDEX IF NOT EXISTS idx_clicks_time ON clicks (time);
+		CREATE INDEX IF NOT EXISTS idx_clicks_search ON clicks (search);
+	`); err != nil {
+		return nil, err
+	}
+
+	a := Analytics{
+		fs:        fs,
+		Retention: 90 * 24 * time.Hour,
+	}
+
+	fs.OnSearch(func(e *SearchEvent) {
+		if strings.TrimSpace(e.Query) == "" {
+			return
+		}
+		a.mut.Lock()
+		if len(a.searches)+len(a.clicks) < analyticsBuffer {
+			a.searches = append(a.searches, *e)
+		}
+		a.mut.Unlock()
+	})
+
+	return &a, nil
+}
+
+func (a *Analytics) client(ip string) string {
+	if a.Anonymize {
+		return anonymizeIP(ip)
+	}
+	return ip
+}
+
+// statusWriter remembers the status code of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Downloads records the downloads served by han that follow a search, i.e. that are referred
+// to by a search results page of the same host. Partial requests are only counted once.
+func (a *Analytics) Downloads(han http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := statusWriter{ResponseWriter: w, status: http.StatusOK}
+		han.ServeHTTP(&sw, r)
+
+		if r.Method != "GET" || (sw.status != http.StatusOK && sw.status != http.StatusPartialContent) {
+			return
+		}
+		if rg := r.Header.Get("Range"); rg != "" && !strings.HasPrefix(rg, "bytes=0-") {
+			return
+		}
+
+		ref, err := url.Parse(r.Referer())
+		if err != nil || ref.Host != r.Host {
+			return
+		}
+		q := normQuery(ref.Query().Get("q"))
+		if q == "" {
+			return
+		}
+
+		h, _, _ := net.SplitHostPort(r.RemoteAddr)
+		a.mut.Lock()
+		if len(a.searches)+len(a.clicks) < analyticsBuffer {
+			a.clicks = append(a.clicks, clickRecord{time: time.Now(), norm: q, path: "/" + strings.TrimPrefix(r.URL.Path, "/"), client: a.client(h)})
+		}
+		a.mut.Unlock()
+	})
+}
+
+// flush writes the recorded searches and downloads to the database, and discards expired records
+func (a *Analytics) flush(ctx context.Context) error {
+	a.mut.Lock()
+	searches, clicks := a.searches, a.clicks
+	a.searches, a.clicks = nil, nil
+	a.mut.Unlock()
+
+	err := a.write(ctx, searches, clicks)
+	if err != nil {
+		// Try again later
+		a.mut.Lock()
+		if len(a.searches)+len(a.clicks)+len(searches)+len(clicks) < analyticsBuffer {
+			a.searches = append(searches, a.searches...)
+			a.clicks = append(clicks, a.clicks...)
+		}
+		a.mut.Unlock()
+	}
+	return err
+}
+
+func (a *Analytics) write(ctx context.Context, searches []SearchEvent, clicks []clickRecord) error {
+	tx, err := a.fs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ins, err := tx.Prepare("INSERT INTO searches (time, query, norm, mode, dir, results, latency, client) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	for _, s := range searches {
+		if _, err := ins.Exec(s.Time.Unix(), s.Query, normQuery(s.Query), s.Mode, s.Dir, s.Results, s.Latency.Microseconds(), a.client(s.Client)); err != nil {
+			return err
+		}
+	}
+
+	// Attribute downloads to the last search for the query by the same client
+	click, err := tx.Prepare(`INSERT INTO clicks (time, search, norm, path) VALUES (?, (SELECT rowid FROM searches
+		WHERE norm = ? AND client = ? AND time BETWEEN ? AND ? ORDER BY time DESC, rowid DESC LIMIT 1), ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer click.Close()
+
+	for _, c := range clicks {
+		t := c.time.Unix()
+		if _, err := click.Exec(t, c.norm, c.client, t-int64(analyticsSession/time.Second), t, c.norm, c.path); err != nil {
+			return err
+		}
+	}
+
+	if a.Retention > 0 {
+		old := time.Now().Add(-a.Retention).Unix()
+		if _, err := tx.Exec("DELETE FROM searches WHERE time < ?", old); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM clicks WHERE time < ?", old); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Run writes the recorded searches and downloads every analyticsFlush, until ctx is done
+func (a *Analytics) Run(ctx context.Context) {
+	t := time.NewTicker(analyticsFlush)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		if err := a.flush(ctx); err != nil && ctx.Err() == nil {
+			logErr.Printf("Analytics: %s\n", err.Error())
+		}
+	}
+}
+
+// Close writes the remaining records
+func (a *Analytics) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), analyticsFlush)
+	defer cancel()
+	return a.flush(ctx)
+}
+
+// QueryStat summarizes the searches for a (normalized) query
+type QueryStat struct {
+	Query   string  `json:"query"`
+	Count   int64   `json:"count"`
+	Results float64 `json:"results"`
+	Clicks  int64   `json:"clicks"`
+	Last    int64   `json:"last"`
+}
+
+// DownloadStat counts the downloads of a file that followed a query
+type DownloadStat struct {
+	Query string `json:"query"`
+	Path  string `json:"path"`
+	Count int64  `json:"count"`
+}
+
+// SearchReport aggregates the searches since a point in time
+type SearchReport struct {
+	Since    int64 `json:"since"`
+	Searches int64 `json:"searches"`
+
+	// Searches without results
+	Zero int64 `json:"zero"`
+
+	// Fraction of searches with results that were followed by a download
+	Clickthrough float64 `json:"clickthrough"`
+
+	// Mean and 95th percentile of the time it took to serve searches, in milliseconds
+	Latency struct {
+		Mean float64 `json:"mean"`
+		P95  float64 `json:"p95"`
+	} `json:"latency"`
+
+	Top       []QueryStat    `json:"top"`
+	Missing   []QueryStat    `json:"missing"`
+	Downloads []DownloadStat `json:"downloads"`
+}
+
+// Report aggregates the searches since unix time since, with up to n queries (or downloads) per list
+func (a *Analytics) Report(ctx context.Context, since int64, n int) (*SearchReport, error) {
+	db := a.fs.db
+	res := SearchReport{Since: since}
+
+	var clicked, found int64
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*), IFNULL(SUM(results = 0), 0), IFNULL(SUM(results > 0), 0), IFNULL(AVG(latency), 0) / 1000.0,
+		(SELECT COUNT(DISTINCT search) FROM clicks WHERE time >= ? AND search IS NOT NULL)
+		FROM searches WHERE time >= ?`, since, since).Scan(&res.Searches, &res.Zero, &found, &res.Latency.Mean, &clicked); err != nil {
+		return nil, err
+	}
+	if found > 0 {
+		res.Clickthrough = float64(clicked) / float64(found)
+	}
+	if res.Searches > 0 {
+		if err := db.QueryRowContext(ctx, "SELECT latency / 1000.0 FROM searches WHERE time >= ? ORDER BY latency LIMIT 1 OFFSET ?", since, res.Searches*95/100).Scan(&res.Latency.P95); err != nil {
+			return nil, err
+		}
+	}
+
+	queries := func(where string) ([]QueryStat, error) {
+		rows, err := db.QueryContext(ctx, `SELECT norm, COUNT(*), AVG(results), (SELECT COUNT(*) FROM clicks WHERE clicks.norm = searches.norm AND clicks.time >= ?), MAX(time)
+			FROM searches WHERE time >= ? AND `+where+` GROUP BY norm ORDER BY COUNT(*) DESC, MAX(time) DESC LIMIT ?`, since, since, n)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		res := make([]QueryStat, 0)
+		for rows.Next() {
+			var s QueryStat
+			if err := rows.Scan(&s.Query, &s.Count, &s.Results, &s.Clicks, &s.Last); err != nil {
+				return nil, err
+			}
+			res = append(res, s)
+		}
+		return res, rows.Err()
+	}
+
+	var err error
+	if res.Top, err = queries("1"); err != nil {
+		return nil, err
+	}
+	if res.Missing, err = queries("results = 0"); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT norm, path, COUNT(*) FROM clicks WHERE time >= ? GROUP BY norm, path ORDER BY COUNT(*) DESC, MAX(time) DESC LIMIT ?", since, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res.Downloads = make([]DownloadStat, 0)
+	for rows.Next() {
+		var d DownloadStat
+		if err := rows.Scan(&d.Query, &d.Path, &d.Count); err != nil {
+			return nil, err
+		}
+		res.Downloads = append(res.Downloads, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// ServeHTTP serves a report (since=<unix time or RFC3339 date>, n=<queries>)
+func (a *Analytics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var since int64
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = parseTime(s); err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	n := reportDefault
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if n > reportMax {
+			n = reportMax
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.fs.Timeout)
+	defer cancel()
+
+	// Include the searches that have not been written yet, if the database is not busy
+	if err := a.flush(ctx); err != nil {
+		logErr.Printf("Analytics: %s\n", err.Error())
+	}
+
+	res, err := a.Report(ctx, since, n)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,104 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAnalytics(t *testing.T) {
+	fs, _ := newTestFS(t, "ubuntu-22.04.iso", "debian-12.iso")
+	fill(t, fs)
+
+	a, err := NewAnalytics(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Anonymize = true
+
+	search := func(q string) {
+		r := httptest.NewRequest("GET", "/?r=1&q="+q, nil)
+		fs.serveCache(httptest.NewRecorder(), r)
+	}
+	search("Ubuntu")
+	search("ubuntu")
+	search("%20ubuntu%20")
+	search("debian")
+	search("fedora")
+	search("")
+
+	dl := a.Downloads(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "missing.iso" {
+			http.NotFound(w, r)
+		}
+	}))
+	for _, p := range []string{"ubuntu-22.04.iso", "ubuntu-22.04.iso", "missing.iso"} {
+		r := httptest.NewRequest("GET", "/dl/"+p, nil)
+		r.URL.Path = p
+		r.Header.Set("Referer", "http://example.com/?r=1&q=UBUNTU")
+		dl.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	r := httptest.NewRequest("GET", "/dl/debian-12.iso", nil)
+	r.Header.Set("Referer", "http://elsewhere.com/?q=debian")
+	dl.ServeHTTP(httptest.NewRecorder(), r)
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := a.Report(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Searches != 5 || res.Zero != 1 || res.Clickthrough != 0.25 {
+		t.Fatalf("Unexpected totals %+v\n", res)
+	}
+	if len(res.Top) != 3 || res.Top[0].Query != "ubuntu" || res.Top[0].Count != 3 || res.Top[0].Results != 1 || res.Top[0].Clicks != 2 {
+		t.Fatalf("Unexpected top queries %+v\n", res.Top)
+	}
+	if len(res.Missing) != 1 || res.Missing[0].Query != "fedora" {
+		t.Fatalf("Unexpected zero-result queries %+v\n", res.Missing)
+	}
+	if len(res.Downloads) != 1 || res.Downloads[0] != (DownloadStat{Query: "ubuntu", Path: "/ubuntu-22.04.iso", Count: 2}) {
+		t.Fatalf("Unexpected downloads %+v\n", res.Downloads)
+	}
+
+	var client string
+	if err := fs.db.QueryRow("SELECT DISTINCT client FROM searches").Scan(&client); err != nil {
+		t.Fatal(err)
+	}
+	if client != "192.0.2.0" {
+		t.Fatalf("Expected anonymized client, got %q\n", client)
+	}
+
+	for _, c := range []struct {
+		pw   string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", "/admin/searches?n=5", nil)
+		if c.pw != "" {
+			r.SetBasicAuth("admin", c.pw)
+		}
+		w := httptest.NewRecorder()
+		adminAuth("secret", a).ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Fatalf("%q: Expected status %d, got %d\n", c.pw, c.want, w.Code)
+		}
+		if w.Code == http.StatusOK {
+			var rep SearchReport
+			if err := json.NewDecoder(w.Body).Decode(&rep); err != nil || rep.Searches != 5 {
+				t.Fatalf("Unexpected report %+v (%v)\n", rep, err)
+			}
+		}
+	}
+}
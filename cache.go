@@ -0,0 +1,201 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"unsafe"
+)
+
+// Estimated memory used by a cache entry, besides its key and results
+const cacheEntryOverhead = 256
+
+// resultCache holds search results of the current generation, evicting the least recently used
+type resultCache struct {
+	mut   sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	gen   int64
+	size  int64
+
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type cacheEntry struct {
+	key  string
+	res  SearchResults
+	size int64
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// cacheKey returns the cache key of a search for q (compiled, so that it is normalized like the search itself)
+// in the directories matching glob p, with the entries that filter selects and facets if faceted is set
+func cacheKey(gen int64, p string, mode string, q Query, filter *facetFilter, faceted bool) string {
+	where, args := compileQuery(q, false)
+	key := fmt.Sprintf("%d\x00%s\x00%s\x00%t\x00%s\x00%q", gen, p, mode, faceted, where, args)
+	if fq := filter.query(""); fq != nil {
+		where, args = compileQuery(fq, false)
+		key += fmt.Sprintf("\x00%s\x00%q", where, args)
+	}
+	return key
+}
+
+// resultsSize estimates the memory used by res
+func resultsSize(res *SearchResults) int64 {
+	n := int64(unsafe.Sizeof(*res))
+	for _, f := range res.Files {
+		n += int64(unsafe.Sizeof(f)) + int64(len(f.Name)+len(f.Type)+len(f.Snippet)) + int64(len(f.Matches))*int64(unsafe.Sizeof([2]int{}))
+	}
+	if res.Facets != nil {
+		for _, f := range [][]Facet{res.Facets.Ext, res.Facets.Dir, res.Facets.Size, res.Facets.Year} {
+			for _, v := range f {
+				n += int64(unsafe.Sizeof(v)) + int64(len(v.Value))
+			}
+		}
+	}
+	return n
+}
+
+// copyResults returns a copy of res that can be modified (e.g. by attachAggregates) without affecting res
+func copyResults(res *SearchResults) *SearchResults {
+	c := *res
+	c.Files = make(Files, len(res.Files))
+	copy(c.Files, res.Files)
+	return &c
+}
+
+// get returns a copy of the results for key, or nil if they are not cached
+func (c *resultCache) get(key string) *SearchResults {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return copyResults(&e.Value.(*cacheEntry).res)
+}
+
+// put stores (a copy of) the results for key of generation gen, evicting entries until the cache
+// fits in limit bytes. Results of an older generation, or larger than limit, are ignored.
+func (c *resultCache) put(key string, gen int64, res *SearchResults, limit int64) {
+	n := cacheEntryOverhead + int64(len(key)) + resultsSize(res)
+	if n > limit {
+		return
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if gen < c.gen {
+		return
+	}
+	if gen > c.gen {
+		// Generations of re-read directories are not purged when published
+		c.reset(gen)
+	}
+	if old, ok := c.items[key]; ok {
+		c.remove(old)
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheEntry{key: key, res: *copyResults(res), size: n})
+	c.size += n
+
+	for c.size > limit {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *resultCache) remove(e *list.Element) {
+	ent := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, ent.key)
+	c.size -= ent.size
+}
+
+func (c *resultCache) reset(gen int64) {
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.gen = gen
+	c.size = 0
+}
+
+// purge discards all entries, and only accepts results of generation gen (or newer) from now on
+func (c *resultCache) purge(gen int64) {
+	c.mut.Lock()
+	c.reset(gen)
+	c.mut.Unlock()
+}
+
+// CacheStats of the search result cache
+type CacheStats struct {
+	Generation int64 `json:"generation"`
+	Entries    int   `json:"entries"`
+	Size       int64 `json:"size"`
+	Limit      int64 `json:"limit"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Evictions  int64 `json:"evictions"`
+}
+
+// CacheStats returns the statistics of the search result cache
+func (fs *CachedFS) CacheStats() CacheStats {
+	c := fs.results
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	return CacheStats{
+		Generation: c.gen,
+		Entries:    c.lru.Len(),
+		Size:       c.size,
+		Limit:      fs.CacheSize,
+		Hits:       c.hits,
+		Misses:     c.misses,
+		Evictions:  c.evictions,
+	}
+}
+
+// ServeCacheStats serves the statistics of the search result cache, as JSON or (with format=prometheus) as metrics
+func (fs *CachedFS) ServeCacheStats(w http.ResponseWriter, r *http.Request) {
+	s := fs.CacheStats()
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") != "prometheus" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(s)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range []struct {
+		name string
+		typ  string
+		help string
+		val  int64
+	}{
+		{"autoindex_search_cache_hits_total", "counter", "Searches served from the result cache", s.Hits},
+		{"autoindex_search_cache_misses_total", "counter", "Searches not found in the result cache", s.Misses},
+		{"autoindex_search_cache_evictions_total", "counter", "Results evicted from the cache to stay within its limit", s.Evictions},
+		{"autoindex_search_cache_entries", "gauge", "Results in the cache", int64(s.Entries)},
+		{"autoindex_search_cache_bytes", "gauge", "Estimated memory used by the cache", s.Size},
+		{"autoindex_search_cache_limit_bytes", "gauge", "Memory limit of the cache", s.Limit},
+		{"autoindex_generation", "gauge", "Published index generation", s.Generation},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.typ, m.name, strconv.FormatInt(m.val, 10))
+	}
+}
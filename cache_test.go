@@ -0,0 +1,114 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResultCache(t *testing.T) {
+	fs, root := newTestFS(t, "ubuntu-22.04.iso", "debian-12.iso")
+	fs.CacheSize = 1 << 20
+	fill(t, fs)
+
+	search := func(u string, cache string, n int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		fs.serveCache(w, httptest.NewRequest("GET", u, nil))
+		if c := w.Header().Get("X-Cache"); c != cache {
+			t.Fatalf("%s: Expected cache %s, got %q\n", u, cache, c)
+		}
+		var f Files
+		if err := json.NewDecoder(w.Body).Decode(&f); err != nil {
+			t.Fatal(err)
+		}
+		if len(f) != n {
+			t.Fatalf("%s: Expected %d results, got %+v\n", u, n, f)
+		}
+	}
+
+	search("/?r=1&q=Ubuntu", "MISS", 1)
+	search("/?r=1&q=ubuntu", "HIT", 1)
+	search("/?r=1&q=%20UBUNTU%20", "HIT", 1)
+	search("/?q=ubuntu", "MISS", 1)
+	search("/?r=1&q=ubuntu&mode=fuzzy", "MISS", 1)
+	search("/?r=1&q=ubuntu%20OR%20debian", "MISS", 2)
+	search("/?r=1&q=ubuntu%20or%20debian", "MISS", 0)
+	search("/?r=1&q=ubuntu&ext=txt", "MISS", 0)
+	search("/?r=1&q=ubuntu&ext=iso", "MISS", 1)
+	search("/?r=1&q=ubuntu&ext=ISO", "HIT", 1)
+
+	// A new generation invalidates the cache
+	if err := os.WriteFile(filepath.Join(root, "ubuntu-24.04.iso"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Fill(); err != nil {
+		t.Fatal(err)
+	}
+	if s := fs.CacheStats(); s.Entries != 0 || s.Size != 0 || s.Generation != fs.Generation() {
+		t.Fatalf("Expected empty cache after publish, got %+v\n", s)
+	}
+	search("/?r=1&q=ubuntu", "MISS", 2)
+	search("/?r=1&q=ubuntu", "HIT", 2)
+
+	if s := fs.CacheStats(); s.Hits != 4 || s.Misses != 8 || s.Entries != 1 {
+		t.Fatalf("Unexpected stats %+v\n", s)
+	}
+
+	fs.CacheSize = 0
+	search("/?r=1&q=ubuntu", "", 2)
+}
+
+func TestResultCacheEviction(t *testing.T) {
+	c := newResultCache()
+	res := &SearchResults{Files: Files{{Name: "a", Type: "f"}}, Total: 1}
+	n := cacheEntryOverhead + 1 + resultsSize(res)
+	limit := 2 * n
+
+	c.put("a", 0, res, limit)
+	c.put("b", 0, res, limit)
+	if c.get("a") == nil {
+		t.Fatal("Expected a to be cached")
+	}
+
+	// b is least recently used
+	c.put("c", 0, res, limit)
+	if c.get("b") != nil || c.get("a") == nil || c.get("c") == nil {
+		t.Fatal("Expected b to be evicted")
+	}
+	if c.size != limit || c.evictions != 1 {
+		t.Fatalf("Unexpected size %d (limit %d) and evictions %d\n", c.size, limit, c.evictions)
+	}
+
+	// Results that exceed the limit, or of an older generation, are not cached
+	c.put("d", 0, &SearchResults{Files: make(Files, 100)}, limit)
+	c.put("e", -1, res, limit)
+	if c.get("d") != nil || c.get("e") != nil || c.lru.Len() != 2 {
+		t.Fatal("Unexpected results cached")
+	}
+
+	// Cached results are copied
+	r := c.get("a")
+	r.Files[0].Name = "x"
+	if c.get("a").Files[0].Name != "a" {
+		t.Fatal("Expected cached results to be unaffected")
+	}
+
+	c.purge(1)
+	if c.get("a") != nil || c.size != 0 {
+		t.Fatal("Expected empty cache after purge")
+	}
+
+	// Results of a newer generation replace the cached ones
+	c.put("a", 1, res, limit)
+	c.put("b", 2, res, limit)
+	if c.get("a") != nil || c.get("b") == nil || c.gen != 2 || c.size != n {
+		t.Fatal("Expected cache of the newer generation")
+	}
+}
@@ -0,0 +1,289 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Generation returns the number of the currently published index generation
+func (fs *CachedFS) Generation() int64 {
+	return atomic.LoadInt64(&fs.gen)
+}
+
+// snapshot copies the entries matching where (with full paths) into table
+func snapshot(tx *sql.Tx, table string, where string, args ...interface{}) error {
+	if _, err := tx.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("CREATE TABLE "+table+" AS SELECT dirs.path AS root, files.name AS name, files.dir AS dir, files.size AS size, files.mtime AS mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE "+where, args...); err != nil {
+		return err
+	}
+	_, err := tx.Exec("CREATE INDEX idx_" + table + " ON " + table + " (root, name)")
+	return err
+}
+
+// record compares the entries matching where against the snapshot taken
+// before the refresh (if track is set), logging the differences as a new
+// generation. Returns the new generation, or 0 if nothing changed.
+func (fs *CachedFS) record(tx *sql.Tx, scope string, track bool, where string, args ...interface{}) (int64, error) {
+	gen := fs.Generation() + 1
+	now := time.Now().Unix()
+
+	// Changes unknown, assume the worst
+	if !track {
+		_, err := tx.Exec("INSERT INTO generations (gen, time, scope) VALUES (?, ?, ?)", gen, now, scope)
+		return gen, err
+	}
+
+	if err := snapshot(tx, "diff_new", where, args...); err != nil {
+		return 0, err
+	}
+
+	var cnt [3]int64
+	for i, q := range []string{
+		// Removals go first, so the earliest change of an entry describes its previous state
+		`INSERT INTO changes (gen, time, root, name, dir, op, osize, omtime)
+			SELECT ?, ?, o.root, o.name, o.dir, 'removed', o.size, o.mtime FROM diff_old o
+			LEFT JOIN diff_new n ON n.root = o.root AND n.name = o.name WHERE n.name IS NULL OR n.dir IS NOT o.dir`,
+		`INSERT INTO changes (gen, time, root, name, dir, op, size, mtime)
+			SELECT ?, ?, n.root, n.name, n.dir, 'added', n.size, n.mtime FROM diff_new n
+			LEFT JOIN diff_old o ON o.root = n.root AND o.name = n.name WHERE o.name IS NULL OR o.dir IS NOT n.dir`,
+		`INSERT INTO changes (gen, time, root, name, dir, op, size, mtime, osize, omtime)
+			SELECT ?, ?, n.root, n.name, n.dir, 'modified', n.size, n.mtime, o.size, o.mtime FROM diff_new n
+			JOIN diff_old o ON o.root = n.root AND o.name = n.name
+			WHERE NOT n.dir AND NOT o.dir AND (n.size IS NOT o.size OR n.mtime IS NOT o.mtime)`,
+	} {
+		res, err := tx.Exec(q, gen, now)
+		if err != nil {
+			return 0, err
+		}
+		if cnt[i], err = res.RowsAffected(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec("DROP TABLE diff_old; DROP TABLE diff_new"); err != nil {
+		return 0, err
+	}
+
+	if cnt[0]+cnt[1]+cnt[2] == 0 {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec("INSERT INTO generations (gen, time, scope, added, removed, modified) VALUES (?, ?, ?, ?, ?, ?)", gen, now, scope, cnt[1], cnt[0], cnt[2]); err != nil {
+		return 0, err
+	}
+
+	old := now - int64(fs.Retention/time.Second)
+	if _, err := tx.Exec("DELETE FROM changes WHERE time < ?", old); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM generations WHERE time < ? AND gen < ?", old, gen); err != nil {
+		return 0, err
+	}
+
+	return gen, nil
+}
+
+// OnPublish registers a callback that is invoked whenever a refresh of the index (or one of its subtrees)
+// publishes a new generation. Re-reads of single directories (see FillDir) are not reported, see OnChange.
+func (fs *CachedFS) OnPublish(f func(gen int64)) {
+	fs.lmu.Lock()
+	fs.listeners = append(fs.listeners, f)
+	fs.lmu.Unlock()
+}
+
+// OnChange registers a callback that is invoked whenever a new generation is published, including
+// those of single directories re-read when visited
+func (fs *CachedFS) OnChange(f func(gen int64)) {
+	fs.lmu.Lock()
+	fs.clisteners = append(fs.clisteners, f)
+	fs.lmu.Unlock()
+}
+
+// publish makes generation gen (if any) the current one, notifying the OnPublish
+// listeners too unless only the entries of a single directory changed
+func (fs *CachedFS) publish(gen int64, dir bool) {
+	if gen == 0 {
+		return
+	}
+	atomic.StoreInt64(&fs.gen, gen)
+
+	fs.lmu.RLock()
+	defer fs.lmu.RUnlock()
+	for _, f := range fs.clisteners {
+		f(gen)
+	}
+	if dir {
+		return
+	}
+	for _, f := range fs.listeners {
+		f(gen)
+	}
+}
+
+// changesOf returns the changes logged for generation gen (with full paths)
+func (fs *CachedFS) changesOf(ctx context.Context, gen int64) ([]Change, error) {
+	rows, err := fs.db.QueryContext(ctx, "SELECT rowid, gen, time, root, name, dir, op, size, mtime FROM changes WHERE gen = ? ORDER BY rowid", gen)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Change, 0)
+	for rows.Next() {
+		c, err := scanChange(rows, 0)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+
+	return res, rows.Err()
+}
+
+// scanChange scans a change row, trimming the first trim characters of its path
+func scanChange(rows *sql.Rows, trim int) (Change, error) {
+	var c Change
+	var root string
+	var dir bool
+	var size, mtime sql.NullInt64
+	if err := rows.Scan(&c.ID, &c.Gen, &c.Time, &root, &c.Name, &dir, &c.Op, &size, &mtime); err != nil {
+		return c, err
+	}
+
+	c.Name = root[trim:] + c.Name
+	if dir {
+		c.Type = "d"
+	} else {
+		c.Type = "f"
+	}
+	if size.Valid {
+		c.Size = &size.Int64
+	}
+	if mtime.Valid {
+		c.Mtime = &mtime.Int64
+	}
+	return c, nil
+}
+
+// Change data sent to client
+type Change struct {
+	ID    int64  `json:"id"`
+	Gen   int64  `json:"gen"`
+	Time  int64  `json:"time"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Op    string `json:"op"`
+	Size  *int64 `json:"size,omitempty"`
+	Mtime *int64 `json:"mtime,omitempty"`
+}
+
+// Changes page sent to client
+type Changes struct {
+	Changes []Change `json:"changes"`
+	Next    int64    `json:"next,omitempty"`
+}
+
+// parseTime parses a unix timestamp or RFC3339 date
+func parseTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", s)
+	}
+	return t.Unix(), err
+}
+
+// serveChanges serves the (paginated) log of changes in a subtree, newest first
+func (fs *CachedFS) serveChanges(w http.ResponseWriter, r *http.Request) {
+	if !fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	q := r.URL.Query()
+
+	var since int64
+	if s := q.Get("since"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+
+	before := int64(math.MaxInt64)
+	if s := q.Get("before"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		before = n
+	}
+
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if n < 1000 {
+			limit = n
+		} else {
+			limit = 1000
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	dir := cleanPath(r.URL.Path)
+	trim := len(dir)
+
+	rows, err := fs.db.QueryContext(ctx, "SELECT rowid, gen, time, root, name, dir, op, size, mtime FROM changes WHERE root GLOB ? AND time >= ? AND rowid < ? ORDER BY rowid DESC LIMIT ?", escapeGlob(dir)+"*", since, before, limit)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	defer rows.Close()
+
+	resp := Changes{Changes: make([]Change, 0)}
+	for rows.Next() {
+		c, err := scanChange(rows, trim)
+		if err != nil {
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+
+		resp.Changes = append(resp.Changes, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	if len(resp.Changes) == limit {
+		resp.Next = resp.Changes[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,92 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	fs, root := newTestFS(t, "pub/", "other/")
+	fs.Retention = time.Hour
+	fill(t, fs)
+
+	writeFiles(t, root, "pub/1.txt", "pub/2.txt", "pub/3.txt", "pub/4.txt", "pub/5.txt", "other/x.txt")
+	fill(t, fs)
+	if err := os.Remove(filepath.Join(root, "pub", "1.txt")); err != nil {
+		t.Fatal(err)
+	}
+	fill(t, fs)
+
+	get := func(u string, status int) Changes {
+		t.Helper()
+		w := httptest.NewRecorder()
+		fs.serveChanges(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != status {
+			t.Fatalf("%s: Expected status %d, got %d\n", u, status, w.Code)
+		}
+		var c Changes
+		if status == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return c
+	}
+
+	// Newest first, paginated with before
+	page := get("/pub/?limit=4", http.StatusOK)
+	if len(page.Changes) != 4 || page.Next != page.Changes[3].ID {
+		t.Fatalf("Unexpected first page %+v\n", page)
+	}
+	if c := page.Changes[0]; c.Name != "1.txt" || c.Op != "removed" {
+		t.Fatalf("Expected newest change first, got %+v\n", c)
+	}
+
+	rest := get("/pub/?limit=4&before="+strconv.FormatInt(page.Next, 10), http.StatusOK)
+	if len(rest.Changes) != 2 || rest.Next != 0 {
+		t.Fatalf("Unexpected last page %+v\n", rest)
+	}
+
+	seen := map[string]int{}
+	last := int64(0)
+	for _, c := range append(page.Changes, rest.Changes...) {
+		if last != 0 && c.ID >= last {
+			t.Errorf("Expected descending ids, got %d after %d\n", c.ID, last)
+		}
+		last = c.ID
+		seen[c.Name+" "+c.Op]++
+	}
+	for _, n := range []string{"1.txt removed", "1.txt added", "2.txt added", "3.txt added", "4.txt added", "5.txt added"} {
+		if seen[n] != 1 {
+			t.Errorf("Expected %q once, got %v\n", n, seen)
+		}
+	}
+
+	// Only changes since a point in time
+	if _, err := fs.db.Exec("UPDATE changes SET time = 1000 WHERE op = 'added'"); err != nil {
+		t.Fatal(err)
+	}
+	for _, since := range []string{"2000", url.QueryEscape(time.Unix(2000, 0).UTC().Format(time.RFC3339))} {
+		if res := get("/pub/?since="+since, http.StatusOK); len(res.Changes) != 1 || res.Changes[0].Op != "removed" || res.Next != 0 {
+			t.Errorf("%s: Unexpected changes %+v\n", since, res)
+		}
+	}
+	if res := get("/?since=999", http.StatusOK); len(res.Changes) != 7 {
+		t.Errorf("Expected all changes, got %+v\n", res)
+	}
+
+	get("/pub/?limit=0", http.StatusBadRequest)
+	get("/pub/?before=x", http.StatusBadRequest)
+	get("/pub/?since=x", http.StatusBadRequest)
+}
@@ -0,0 +1,422 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"html"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum number of bytes of text extracted from a file
+const contentText = 1 << 20
+
+// Maximum number of bytes of XML read from an office document, bounding highly compressed archives
+const contentXML = 16 << 20
+
+// Length of the snippet of a content search result, in bytes
+const snippetLength = 160
+
+// Parts of zip-based office documents (OOXML and OpenDocument) holding their text
+var officeParts = regexp.MustCompile(`^(word/document\.xml|xl/sharedStrings\.xml|ppt/slides/slide[0-9]+\.xml|content\.xml)$`)
+
+// Elements of office documents that separate words
+var officeBreaks = map[string]bool{"p": true, "h": true, "br": true, "tab": true, "s": true, "tc": true, "si": true, "line-break": true, "table-cell": true}
+
+var (
+	htmlSkip = regexp.MustCompile(`(?is)<script\b.*?</script\s*>|<style\b.*?</style\s*>|<!--.*?-->`)
+	htmlTag  = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// limitedBuilder keeps the first contentText bytes written to it
+type limitedBuilder struct {
+	strings.Builder
+}
+
+func (b *limitedBuilder) full() bool {
+	return b.Len() >= contentText
+}
+
+func (b *limitedBuilder) space() {
+	if b.Len() > 0 && !b.full() {
+		b.WriteByte(' ')
+	}
+}
+
+func (b *limitedBuilder) text(s string) {
+	if r := contentText - b.Len(); r < len(s) {
+		for r > 0 && !utf8.RuneStart(s[r]) {
+			r--
+		}
+		s = s[:r]
+	}
+	b.WriteString(s)
+}
+
+// plainText returns the text in b, or nothing if it looks like a binary file
+func plainText(b []byte) string {
+	if bytes.IndexByte(b, 0) >= 0 {
+		return ""
+	}
+	return strings.ToValidUTF8(string(b), "")
+}
+
+// htmlText returns the text in HTML document b, without markup, scripts and styles
+func htmlText(b []byte) string {
+	s := htmlSkip.ReplaceAllString(plainText(b), " ")
+	return html.UnescapeString(htmlTag.ReplaceAllString(s, " "))
+}
+
+// officeText returns the text in the zip-based office document r of size bytes
+func officeText(r io.ReaderAt, size int64) (string, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+
+	var b limitedBuilder
+	budget := int64(contentXML)
+	for _, f := range z.File {
+		if !officeParts.MatchString(f.Name) || budget <= 0 || b.full() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+
+		lr := io.LimitedReader{R: rc, N: budget}
+		d := xml.NewDecoder(&lr)
+		d.Strict = false
+		for !b.full() {
+			t, err := d.Token()
+			if err != nil {
+				break
+			}
+			switch t := t.(type) {
+			case xml.CharData:
+				b.text(string(t))
+			case xml.StartElement:
+				if officeBreaks[t.Name.Local] {
+					b.space()
+				}
+			case xml.EndElement:
+				if officeBreaks[t.Name.Local] {
+					b.space()
+				}
+			}
+		}
+		budget = lr.N
+		rc.Close()
+		b.space()
+	}
+
+	return b.String(), nil
+}
+
+// extractText returns the text of file f (named name, of size bytes), up to contentText bytes
+func extractText(name string, f *os.File, size int64) (string, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".docx", ".xlsx", ".pptx", ".odt", ".ods", ".odp":
+		return officeText(f, size)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(f, contentText))
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm", ".xhtml":
+		return htmlText(b), nil
+	default:
+		return plainText(b), nil
+	}
+}
+
+// indexContent extracts the text of the files matching where (with dirs joined) that have one of
+// the Content extensions, and adds their words to the content index. Text is kept as long as the
+// size and modification time of a file are unchanged. If prune is set, the text of all other files
+// is discarded.
+func (fs *CachedFS) indexContent(tx *sql.Tx, prune bool, where string, args ...interface{}) error {
+	if len(fs.Content) == 0 {
+		if prune {
+			_, err := tx.Exec("DELETE FROM content")
+			return err
+		}
+		return nil
+	}
+
+	exts := make(map[string]bool, len(fs.Content))
+	for _, e := range fs.Content {
+		exts[fold(strings.TrimPrefix(e, "."))] = true
+	}
+
+	ins, err := tx.Prepare("INSERT INTO ctokens (token, file) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	get, err := tx.Prepare("SELECT text FROM content WHERE path = ? AND size = ? AND mtime = ?")
+	if err != nil {
+		return err
+	}
+	defer get.Close()
+
+	seen, err := tx.Prepare("UPDATE content SET seen = ? WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer seen.Close()
+
+	put, err := tx.Prepare("INSERT OR REPLACE INTO content (path, size, mtime, text, search, seen) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer put.Close()
+
+	type entry struct {
+		id    int64
+		path  string
+		size  int64
+		mtime int64
+	}
+
+	run := time.Now().UnixNano()
+	size := fs.ContentSize
+	if size <= 0 {
+		size = math.MaxInt64
+	}
+
+	// Read in batches, rather than inserting while the query is running
+	var last int64
+	for {
+		rows, err := tx.Query("SELECT files.rowid, dirs.path || files.name, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.rowid > ? AND NOT files.dir AND files.size <= ? AND ("+where+") ORDER BY files.rowid LIMIT 16384", append([]interface{}{last, size}, args...)...)
+		if err != nil {
+			return err
+		}
+
+		var batch []entry
+		for rows.Next() {
+			var e entry
+			var mtime sql.NullInt64
+			if err := rows.Scan(&e.id, &e.path, &e.size, &mtime); err != nil {
+				rows.Close()
+				return err
+			}
+			e.mtime = mtime.Int64
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		last = batch[len(batch)-1].id
+
+		for _, e := range batch {
+			if !exts[fold(strings.TrimPrefix(path.Ext(e.path), "."))] {
+				continue
+			}
+
+			var text string
+			if err := get.QueryRow(e.path, e.size, e.mtime).Scan(&text); err == nil {
+				if _, err := seen.Exec(run, e.path); err != nil {
+					return err
+				}
+			} else if err != sql.ErrNoRows {
+				return err
+			} else if text, err = fs.readContent(e.path, e.size, e.mtime); err != nil {
+				logErr.Printf("Content: %s\n", err.Error())
+				continue
+			} else if _, err := put.Exec(e.path, e.size, e.mtime, text, fold(text), run); err != nil {
+				return err
+			}
+
+			known := map[string]bool{}
+			var err error
+			scanTokens(text, func(t token) bool {
+				if known[t.text] {
+					return true
+				}
+				known[t.text] = true
+				_, err = ins.Exec(t.text, e.id)
+				return err == nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if prune {
+		_, err := tx.Exec("DELETE FROM content WHERE seen < ?", run)
+		return err
+	}
+	return nil
+}
+
+// readContent extracts the text of file p (relative to root), if its size and mtime are unchanged
+func (fs *CachedFS) readContent(p string, size int64, mtime int64) (string, error) {
+	f, err := os.Open(filepath.Join(fs.Root, filepath.FromSlash(p)))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Skip files that changed since they were indexed
+	if s, m := stat(f.Name()); s != size || m != mtime {
+		return "", nil
+	}
+	return extractText(p, f, size)
+}
+
+// contentTerms returns the content words and phrases that q requires
+func contentTerms(q Query) []*queryContent {
+	var res []*queryContent
+	var walk func(q Query)
+	walk = func(q Query) {
+		switch q := q.(type) {
+		case queryAnd:
+			for _, x := range q {
+				walk(x)
+			}
+		case queryOr:
+			for _, x := range q {
+				walk(x)
+			}
+		case *queryContent:
+			res = append(res, q)
+		}
+	}
+	walk(q)
+	return res
+}
+
+// hasContent reports whether q searches file contents (including excluded words)
+func hasContent(q Query) bool {
+	switch q := q.(type) {
+	case queryAnd:
+		for _, x := range q {
+			if hasContent(x) {
+				return true
+			}
+		}
+	case queryOr:
+		for _, x := range q {
+			if hasContent(x) {
+				return true
+			}
+		}
+	case queryNot:
+		return hasContent(q.x)
+	case *queryContent:
+		return true
+	}
+	return false
+}
+
+// snippet returns the text around the first match of c in text, on a single line
+func snippet(text string, c []*queryContent) string {
+	at := -1
+	scanTokens(text, func(t token) bool {
+		for _, q := range c {
+			for _, w := range q.words {
+				if strings.HasPrefix(t.text, w) {
+					at = t.start
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if at < 0 {
+		return ""
+	}
+
+	start := at - snippetLength/3
+	if n := len(text) - snippetLength; start > n {
+		start = n
+	}
+	if start <= 0 {
+		start = 0
+	} else {
+		// Start at a word
+		for start < at && !unicode.IsSpace(rune(text[start])) {
+			start++
+		}
+	}
+	end := start + snippetLength
+	if end >= len(text) {
+		end = len(text)
+	} else {
+		for end > at && !unicode.IsSpace(rune(text[end])) {
+			end--
+		}
+	}
+	for start < end && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	res := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		res = "…" + res
+	}
+	if end < len(text) {
+		res += "…"
+	}
+	return res
+}
+
+// snippets sets the snippet of every file in f (relative to dir) that matches the content of q
+func (fs *CachedFS) snippets(ctx context.Context, dir string, q Query, f Files) error {
+	c := contentTerms(q)
+	if len(c) == 0 || len(f) == 0 {
+		return nil
+	}
+
+	st, err := fs.db.PrepareContext(ctx, "SELECT text FROM content WHERE path = ?")
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	for i := range f {
+		if f[i].Type != "f" {
+			continue
+		}
+
+		var text string
+		if err := st.QueryRowContext(ctx, dir+f[i].Name).Scan(&text); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		f[i].Snippet = snippet(text, c)
+	}
+	return nil
+}
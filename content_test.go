@@ -0,0 +1,110 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestContent(t *testing.T) {
+	fs, root := newTestFS(t, "docs/")
+
+	var docx bytes.Buffer
+	z := zip.NewWriter(&docx)
+	for name, body := range map[string]string{
+		"word/document.xml": `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Quarterly </w:t></w:r><w:r><w:t>Rev</w:t></w:r><w:r><w:t>enue</w:t></w:r></w:p><w:p><w:r><w:t>report</w:t></w:r></w:p></w:body></w:document>`,
+		"word/styles.xml":   `<w:styles xmlns:w="w"><w:style>Kubernetes</w:style></w:styles>`,
+	} {
+		w, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	z.Close()
+
+	for name, body := range map[string]string{
+		"docs/notes.md":    "# Setup\n\nDeploy the cluster with *Kubernetes* and `helm`.\n" + strings.Repeat("Filler text. ", 40) + "The Café opens at nine.",
+		"docs/index.html":  "<html><head><style>body { kubernetes: 1 }</style><script>var helm;</script></head><body><p>Caf&eacute; menu</p></body></html>",
+		"docs/report.docx": docx.String(),
+		"docs/binary.txt":  "kubernetes\x00\x01",
+		"docs/skipped.log": "kubernetes",
+	} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.Content = []string{"md", "html", "docx", "txt"}
+	fill(t, fs)
+
+	search := func(q string) Files {
+		t.Helper()
+		n, err := parseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := fs.search(context.Background(), "/*", 1, n, false)
+		if err == nil {
+			err = fs.snippets(context.Background(), "/", n, res)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := search("content:kubernetes"); len(res) != 1 || res[0].Name != "docs/notes.md" || !strings.HasPrefix(res[0].Snippet, "# Setup Deploy the cluster with *Kubernetes*") || !strings.HasSuffix(res[0].Snippet, "…") {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("content:cafe"); len(res) != 2 || res[0].Name != "docs/notes.md" || !strings.HasPrefix(res[0].Snippet, "…") || !strings.HasSuffix(res[0].Snippet, "The Café opens at nine.") || res[1].Snippet != "Café menu" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("content:\"quarterly revenue\""); len(res) != 1 || res[0].Snippet != "Quarterly Revenue report" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("content:menu ext:md"); len(res) != 0 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("content:helm -content:cafe"); len(res) != 0 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	// Changed files are extracted again, removed files are forgotten
+	if err := os.WriteFile(filepath.Join(root, "docs", "notes.md"), []byte("Nomad"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "docs", "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FillPath("/docs/notes.md"); err != nil {
+		t.Fatal(err)
+	}
+	if res := search("content:nomad"); len(res) != 1 || res[0].Snippet != "Nomad" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("content:kubernetes"); len(res) != 0 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	fill(t, fs)
+	var n int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM content").Scan(&n); err != nil || n != 3 {
+		t.Errorf("Unexpected content count %d (%v)\n", n, err)
+	}
+	if res := search("content:menu"); len(res) != 0 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	if _, err := parseQuery("content:\"\""); err != ErrQuery {
+		t.Errorf("Expected error, got %v\n", err)
+	}
+}
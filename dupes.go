@@ -0,0 +1,333 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DuplicateGroup is a set of files with identical contents
+type DuplicateGroup struct {
+	Hash        string   `json:"hash"`
+	Size        int64    `json:"size"`
+	Files       []string `json:"files"`
+	Reclaimable int64    `json:"reclaimable"`
+}
+
+// DuplicateReport lists all groups of duplicate files, most reclaimable space first
+type DuplicateReport struct {
+	Gen         int64            `json:"gen"`
+	Time        int64            `json:"time"`
+	Groups      []DuplicateGroup `json:"groups"`
+	Reclaimable int64            `json:"reclaimable"`
+}
+
+type candidate struct {
+	path  string
+	size  int64
+	mtime int64
+}
+
+// candidates returns the files that share their size with another file
+func (fs *CachedFS) candidates(ctx context.Context) ([]candidate, error) {
+	rows, err := fs.db.QueryContext(ctx, `SELECT dirs.path || files.name, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid
+		WHERE NOT files.dir AND files.size IN (SELECT size FROM files WHERE NOT dir AND size > 0 GROUP BY size HAVING COUNT(*) > 1)
+		ORDER BY files.size DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []candidate
+	for rows.Next() {
+		var c candidate
+		var mtime sql.NullInt64
+		if err := rows.Scan(&c.path, &c.size, &mtime); err != nil {
+			return nil, err
+		}
+		c.mtime = mtime.Int64
+		res = append(res, c)
+	}
+
+	return res, rows.Err()
+}
+
+// storedHash is the hash of a file, valid as long as its size and modification time are unchanged
+type storedHash struct {
+	size  int64
+	mtime int64
+	hash  string
+	file  string
+}
+
+// storedHashes returns the hashes cached in the database by path
+func (fs *CachedFS) storedHashes(ctx context.Context) (map[string]*storedHash, error) {
+	rows, err := fs.db.QueryContext(ctx, "SELECT path, size, mtime, hash, file FROM hashes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]*storedHash)
+	for rows.Next() {
+		var p string
+		var h storedHash
+		if err := rows.Scan(&p, &h.size, &h.mtime, &h.hash, &h.file); err != nil {
+			return nil, err
+		}
+		res[p] = &h
+	}
+
+	return res, rows.Err()
+}
+
+// hash returns the SHA-256 of candidate c and the identity of the file it is stored in
+// (equal for hard links), or nil if the file changed since it was indexed
+func (fs *CachedFS) hash(ctx context.Context, c *candidate) (*storedHash, error) {
+	f, err := os.Open(filepath.Join(fs.Root, filepath.FromSlash(c.path)))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip files that changed since they were indexed
+	if fi.Size() != c.size || fi.ModTime().Unix() != c.mtime {
+		return nil, nil
+	}
+
+	s := sha256.New()
+	if _, err := io.Copy(s, &ctxReader{ctx: ctx, r: f}); err != nil {
+		return nil, err
+	}
+
+	return &storedHash{size: c.size, mtime: c.mtime, hash: hex.EncodeToString(s.Sum(nil)), file: fileID(fi)}, nil
+}
+
+// storeHashes replaces the cached hashes by those of the current candidates,
+// writing only the new hashes and deleting the ones that are no longer used
+func (fs *CachedFS) storeHashes(ctx context.Context, added map[string]*storedHash, unused []string) error {
+	if len(added) == 0 && len(unused) == 0 {
+		return nil
+	}
+
+	tx, err := fs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, p := range unused {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM hashes WHERE path = ?", p); err != nil {
+			return err
+		}
+	}
+	for p, h := range added {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO hashes (path, size, mtime, hash, file) VALUES (?, ?, ?, ?, ?)", p, h.size, h.mtime, h.hash, h.file); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ctxReader stops reading when ctx is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Duplicates finds files with identical contents, comparing sizes first and content hashes second.
+// Only files that are new or changed since the previous run are read. Hard links of the same file
+// are listed, but not counted as reclaimable.
+func (fs *CachedFS) Duplicates(ctx context.Context) (*DuplicateReport, error) {
+	gen := fs.Generation()
+	run := time.Now().Unix()
+
+	cand, err := fs.candidates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := fs.storedHashes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]*storedHash)
+	groups := make(map[string]*DuplicateGroup)
+	files := make(map[string]map[string]bool)
+	for i := range cand {
+		c := &cand[i]
+		h := stored[c.path]
+		if h != nil && h.size == c.size && h.mtime == c.mtime {
+			delete(stored, c.path)
+		} else if h, err = fs.hash(ctx, c); ctx.Err() != nil {
+			return nil, ctx.Err()
+		} else if err != nil {
+			logErr.Printf("Duplicates: %s\n", err.Error())
+			continue
+		} else if h == nil {
+			continue
+		} else {
+			added[c.path] = h
+		}
+
+		g := groups[h.hash]
+		if g == nil {
+			g = &DuplicateGroup{Hash: h.hash, Size: c.size}
+			groups[h.hash] = g
+			files[h.hash] = make(map[string]bool)
+		}
+		g.Files = append(g.Files, c.path)
+
+		// Without a file identity, every path is a separate file
+		if h.file != "" {
+			files[h.hash][h.file] = true
+		} else {
+			files[h.hash]["path:"+c.path] = true
+		}
+	}
+
+	// Forget hashes of files that are gone, changed or no longer have a same-sized twin
+	unused := make([]string, 0, len(stored))
+	for p := range stored {
+		if added[p] == nil {
+			unused = append(unused, p)
+		}
+	}
+	if err := fs.storeHashes(ctx, added, unused); err != nil {
+		return nil, err
+	}
+
+	res := DuplicateReport{Gen: gen, Time: run, Groups: make([]DuplicateGroup, 0)}
+	for h, g := range groups {
+		n := int64(len(files[h]))
+		if n < 2 {
+			continue
+		}
+		sort.Strings(g.Files)
+		g.Reclaimable = g.Size * (n - 1)
+		res.Reclaimable += g.Reclaimable
+		res.Groups = append(res.Groups, *g)
+	}
+
+	sort.Slice(res.Groups, func(i, j int) bool {
+		if res.Groups[i].Reclaimable != res.Groups[j].Reclaimable {
+			return res.Groups[i].Reclaimable > res.Groups[j].Reclaimable
+		}
+		return res.Groups[i].Files[0] < res.Groups[j].Files[0]
+	})
+
+	return &res, nil
+}
+
+// Under returns the report limited to groups with files in subtree dir
+func (r *DuplicateReport) Under(dir string) *DuplicateReport {
+	if dir == "/" {
+		return r
+	}
+
+	res := DuplicateReport{Gen: r.Gen, Time: r.Time, Groups: make([]DuplicateGroup, 0)}
+	for _, g := range r.Groups {
+		for _, f := range g.Files {
+			if strings.HasPrefix(f, dir) {
+				res.Groups = append(res.Groups, g)
+				res.Reclaimable += g.Reclaimable
+				break
+			}
+		}
+	}
+	return &res
+}
+
+// Dupes keeps the duplicate report up to date with the published generation
+type Dupes struct {
+	fs   *CachedFS
+	wake chan struct{}
+	mut  sync.RWMutex
+	last *DuplicateReport
+}
+
+// NewDupes for fs
+func NewDupes(fs *CachedFS) *Dupes {
+	d := Dupes{fs: fs, wake: make(chan struct{}, 1)}
+
+	fs.OnPublish(func(gen int64) {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	})
+
+	return &d
+}
+
+// Run updates the report after every published generation, until ctx is done
+func (d *Dupes) Run(ctx context.Context) {
+	for {
+		if d.fs.DBReady() {
+			start := time.Now()
+			r, err := d.fs.Duplicates(ctx)
+			if err != nil && ctx.Err() == nil {
+				logErr.Printf("Duplicates: %s\n", err.Error())
+			} else if err == nil {
+				logErr.Printf("%d groups of duplicates found (%d bytes reclaimable) in %s\n", len(r.Groups), r.Reclaimable, time.Since(start).Round(time.Millisecond))
+
+				d.mut.Lock()
+				d.last = r
+				d.mut.Unlock()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		}
+	}
+}
+
+// ServeHTTP serves the last report, limited to groups with files in the requested subtree
+func (d *Dupes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mut.RLock()
+	last := d.last
+	d.mut.RUnlock()
+
+	if last == nil {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	resp := last.Under(cleanPath(r.URL.Path))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	json.NewEncoder(w).Encode(resp)
+}
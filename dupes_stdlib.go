@@ -0,0 +1,16 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"os"
+)
+
+func fileID(fi os.FileInfo) string {
+	return ""
+}
@@ -0,0 +1,86 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	fs, root := newTestFS(t)
+	for name, data := range map[string]string{
+		"a.bin": "hello world",
+		"b.bin": "hello world",
+		"c.bin": "hello WORLD",
+		"e.bin": "hello links",
+		"x.txt": "unique",
+	} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, l := range [][2]string{{"a.bin", "d.bin"}, {"e.bin", "f.bin"}} {
+		if err := os.Link(filepath.Join(root, l[0]), filepath.Join(root, l[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fill(t, fs)
+
+	check := func(reclaimable int64, want ...[]string) {
+		t.Helper()
+		r, err := fs.Duplicates(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]string
+		for _, g := range r.Groups {
+			got = append(got, g.Files)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected groups %v, got %v\n", want, got)
+		}
+		if r.Reclaimable != reclaimable {
+			t.Fatalf("Expected %d reclaimable bytes, got %d\n", reclaimable, r.Reclaimable)
+		}
+	}
+
+	// Same size with different content, and hard links of one file, are not reclaimable
+	check(11, []string{"/a.bin", "/b.bin", "/d.bin"})
+
+	var n int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM hashes").Scan(&n); err != nil || n != 6 {
+		t.Fatalf("Expected 6 cached hashes, got %d (%v)\n", n, err)
+	}
+
+	// Unchanged files are not read again
+	if _, err := fs.db.Exec("UPDATE hashes SET hash = (SELECT hash FROM hashes WHERE path = '/a.bin') WHERE path = '/c.bin'"); err != nil {
+		t.Fatal(err)
+	}
+	check(22, []string{"/a.bin", "/b.bin", "/c.bin", "/d.bin"})
+
+	// Changed and removed files are
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "c.bin"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(root, "f.bin")); err != nil {
+		t.Fatal(err)
+	}
+	fill(t, fs)
+	check(11, []string{"/a.bin", "/b.bin", "/d.bin"})
+
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM hashes WHERE path = '/f.bin'").Scan(&n); err != nil || n != 0 {
+		t.Fatalf("Expected hash of removed file to be dropped, got %d (%v)\n", n, err)
+	}
+}
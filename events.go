@@ -0,0 +1,259 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of event streams per client address
+const eventsPerIP = 8
+
+// Number of buffered event batches per subscriber, before it is disconnected for being too slow
+const eventsBuffer = 16
+
+// Events broadcasts changes to subscribed clients as server-sent events
+type Events struct {
+	fs    *CachedFS
+	mut   sync.Mutex
+	subs  map[*subscriber]struct{}
+	perIP map[string]int
+	quit  chan struct{}
+
+	MaxClients int
+	Heartbeat  time.Duration
+}
+
+type subscriber struct {
+	dir       string
+	recursive bool
+	ch        chan []Change
+}
+
+// matches reports whether a change (with full path) is of interest to the subscriber
+func (s *subscriber) matches(c *Change) bool {
+	if s.recursive {
+		return strings.HasPrefix(c.Name, s.dir)
+	}
+	return path.Dir(c.Name) == path.Clean(s.dir)
+}
+
+// NewEvents hub, broadcasting every generation published by fs
+func NewEvents(fs *CachedFS) *Events {
+	e := Events{
+		fs:         fs,
+		subs:       make(map[*subscriber]struct{}),
+		perIP:      make(map[string]int),
+		quit:       make(chan struct{}),
+		MaxClients: 256,
+		Heartbeat:  30 * time.Second,
+	}
+
+	fs.OnChange(e.broadcast)
+	return &e
+}
+
+// Close disconnects all subscribers
+func (e *Events) Close() {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	select {
+	case <-e.quit:
+	default:
+		close(e.quit)
+	}
+}
+
+func (e *Events) broadcast(gen int64) {
+	e.mut.Lock()
+	n := len(e.subs)
+	e.mut.Unlock()
+	if n == 0 {
+		return
+	}
+
+	changes, err := e.fs.changesOf(context.Background(), gen)
+	if err != nil {
+		logErr.Printf("Events: %s\n", err.Error())
+		return
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	for s := range e.subs {
+		// Generation without change log, let subscriber reload
+		var batch []Change
+		if len(changes) == 0 {
+			batch = []Change{{Gen: gen, Op: "refresh"}}
+		}
+		for i := range changes {
+			if s.matches(&changes[i]) {
+				batch = append(batch, changes[i])
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		select {
+		case s.ch <- batch:
+		default:
+			// Too slow, drop subscriber
+			close(s.ch)
+			delete(e.subs, s)
+		}
+	}
+}
+
+func (e *Events) subscribe(s *subscriber, ip string) bool {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if len(e.subs) >= e.MaxClients || e.perIP[ip] >= eventsPerIP {
+		return false
+	}
+
+	e.subs[s] = struct{}{}
+	e.perIP[ip]++
+	return true
+}
+
+func (e *Events) unsubscribe(s *subscriber, ip string) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	delete(e.subs, s)
+	if e.perIP[ip]--; e.perIP[ip] <= 0 {
+		delete(e.perIP, ip)
+	}
+}
+
+// Maximum number of changes replayed to a reconnecting subscriber, before it is told to reload instead
+const eventsReplay = 1000
+
+// replay returns the logged changes after event id last, ending with a refresh if
+// there are more than eventsReplay
+func (e *Events) replay(ctx context.Context, s *subscriber, last int64) ([]Change, error) {
+	// Same selection as subscriber.matches
+	where, arg := "root = ?", s.dir
+	if s.recursive {
+		where, arg = "root GLOB ?", escapeGlob(s.dir)+"*"
+	}
+
+	rows, err := e.fs.db.QueryContext(ctx, "SELECT rowid, gen, time, root, name, dir, op, size, mtime FROM changes WHERE rowid > ? AND "+where+" ORDER BY rowid LIMIT ?", last, arg, eventsReplay+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Change
+	for rows.Next() {
+		c, err := scanChange(rows, 0)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	if len(res) > eventsReplay {
+		res = append(res[:eventsReplay], Change{Gen: e.fs.Generation(), Op: "refresh"})
+	}
+
+	return res, rows.Err()
+}
+
+func writeEvents(w http.ResponseWriter, trim int, batch []Change) error {
+	for _, c := range batch {
+		if c.Op == "refresh" {
+			if _, err := fmt.Fprintf(w, "event: refresh\ndata: {\"gen\":%d}\n\n", c.Gen); err != nil {
+				return err
+			}
+			continue
+		}
+
+		c.Name = c.Name[trim:]
+		b, err := json.Marshal(&c)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.ID, c.Op, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP streams the changes in a directory (or subtree if r is set) as server-sent events
+func (e *Events) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	s := subscriber{
+		dir:       cleanPath(r.URL.Path),
+		recursive: r.URL.Query().Get("r") != "",
+		ch:        make(chan []Change, eventsBuffer),
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !e.subscribe(&s, ip) {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer e.unsubscribe(&s, ip)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", retryAfter*1000)
+
+	trim := len(s.dir)
+	if last, err := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); err == nil && e.fs.DBReady() {
+		ctx, cancel := context.WithTimeout(r.Context(), e.fs.Timeout)
+		batch, err := e.replay(ctx, &s, last)
+		cancel()
+
+		if err != nil {
+			logErr.Printf("Events: %s\n", err.Error())
+		} else if writeEvents(w, trim, batch) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(e.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-e.quit:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case batch, ok := <-s.ch:
+			if !ok || writeEvents(w, trim, batch) != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,150 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type event struct {
+	id   string
+	name string
+	data Change
+}
+
+// readEvents reads n events from a server-sent event stream
+func readEvents(t *testing.T, r *bufio.Reader, n int) []event {
+	t.Helper()
+	var res []event
+	var ev event
+	for len(res) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected %d events, got %+v (%v)\n", n, res, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ev.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			ev.name = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(line[6:]), &ev.data); err != nil {
+				t.Fatal(err)
+			}
+		case line == "" && ev.name != "":
+			res = append(res, ev)
+			ev = event{}
+		}
+	}
+	return res
+}
+
+func TestEvents(t *testing.T) {
+	fs, root := newTestFS(t, "pub/sub/")
+	fs.Retention = time.Hour
+	fill(t, fs)
+
+	// Changes in a subdirectory that come before those of the directory itself
+	if _, err := fs.db.Exec(`WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1500)
+		INSERT INTO changes (gen, time, root, name, dir, op) SELECT 0, strftime('%s', 'now'), '/pub/sub/', 'noise' || i, 0, 'added' FROM n`); err != nil {
+		t.Fatal(err)
+	}
+	writeFiles(t, root, "pub/a.txt", "pub/b.txt")
+	fill(t, fs)
+
+	e := NewEvents(fs)
+	defer e.Close()
+	srv := httptest.NewServer(http.StripPrefix("/events", e))
+	defer srv.Close()
+
+	connect := func(u string, last string) (*http.Response, *bufio.Reader) {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last != "" {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: Unexpected status %d\n", u, resp.StatusCode)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	// Replay of the directory is not crowded out by its subdirectories
+	resp, r := connect("/events/pub/", "0")
+	evs := readEvents(t, r, 2)
+	for _, ev := range evs {
+		if ev.name != "added" || ev.id != strconv.FormatInt(ev.data.ID, 10) || (ev.data.Name != "a.txt" && ev.data.Name != "b.txt") {
+			t.Fatalf("Unexpected replay %+v\n", evs)
+		}
+	}
+	last := evs[1].id
+
+	// Live changes
+	writeFiles(t, root, "pub/c.txt")
+	fill(t, fs)
+	if evs := readEvents(t, r, 1); evs[0].data.Name != "c.txt" || evs[0].name != "added" {
+		t.Fatalf("Unexpected event %+v\n", evs)
+	}
+	resp.Body.Close()
+
+	// Reconnect with the last seen id
+	resp, r = connect("/events/pub/", last)
+	if evs := readEvents(t, r, 1); evs[0].data.Name != "c.txt" {
+		t.Fatalf("Unexpected replay %+v\n", evs)
+	}
+	resp.Body.Close()
+
+	// Subtrees replay at most eventsReplay changes, then ask to reload
+	resp, r = connect("/events/pub/?r=1", "0")
+	evs = readEvents(t, r, eventsReplay+1)
+	if evs[0].data.Name != "sub/noise1" || evs[eventsReplay].name != "refresh" {
+		t.Fatalf("Unexpected replay %+v ... %+v\n", evs[0], evs[eventsReplay])
+	}
+	resp.Body.Close()
+
+	// Streams per address
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		e.mut.Lock()
+		n := len(e.subs)
+		e.mut.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected closed streams to unsubscribe")
+		}
+	}
+	for i := 0; i < eventsPerIP; i++ {
+		if !e.subscribe(&subscriber{}, "192.0.2.1") {
+			t.Fatalf("Expected stream %d to be accepted\n", i+1)
+		}
+	}
+	if !e.subscribe(&subscriber{}, "192.0.2.2") {
+		t.Fatal("Expected stream of other address to be accepted")
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/pub/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	e.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 503 with Retry-After, got %d %v\n", w.Code, w.Header())
+	}
+}
@@ -0,0 +1,306 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"math"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of values of a facet
+const facetValues = 100
+
+// Facets that search results are counted by, and the parameters that filter them
+const (
+	facetExt = iota
+	facetDir
+	facetSize
+	facetYear
+	facetCount
+)
+
+var facetParams = [facetCount]string{"ext", "dir", "size", "year"}
+
+// Size buckets, as the upper bound of the sizes they hold
+var sizeBuckets = []struct {
+	name string
+	hi   int64
+}{
+	{"0-1K", 1 << 10},
+	{"1K-1M", 1 << 20},
+	{"1M-100M", 100 << 20},
+	{"100M-1G", 1 << 30},
+	{"1G-10G", 10 << 30},
+	{"10G-", math.MaxInt64},
+}
+
+// Facet value, with the number of matching entries
+type Facet struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+// Facets of search results
+type Facets struct {
+	Ext  []Facet `json:"ext"`
+	Dir  []Facet `json:"dir"`
+	Size []Facet `json:"size"`
+	Year []Facet `json:"year"`
+}
+
+// SearchResults sent to client when facets are requested, with the total number of matches
+type SearchResults struct {
+	Files  Files   `json:"files"`
+	Total  int64   `json:"total"`
+	Facets *Facets `json:"facets"`
+}
+
+// facetFilter holds the selected (folded) values of every facet, nil if it is not filtered
+type facetFilter [facetCount]map[string]bool
+
+// parseFacets parses the facet parameters (comma separated values) of a request
+func parseFacets(v url.Values) (facetFilter, error) {
+	var f facetFilter
+	for i, p := range facetParams {
+		for _, s := range v[p] {
+			for _, x := range strings.Split(fold(s), ",") {
+				if x = strings.TrimSpace(x); i == facetExt {
+					x = strings.TrimPrefix(x, ".")
+				}
+				if x == "" {
+					continue
+				}
+
+				switch i {
+				case facetSize:
+					if _, _, ok := bucketRange(x); !ok {
+						return f, ErrQuery
+					}
+				case facetYear:
+					if y, err := strconv.Atoi(x); err != nil || y < 1 || y > 9999 {
+						return f, ErrQuery
+					}
+				}
+
+				if f[i] == nil {
+					f[i] = make(map[string]bool)
+				}
+				f[i][x] = true
+			}
+		}
+	}
+	return f, nil
+}
+
+// query returns the query for the entries (in directory dir) that f selects, nil if it selects all
+func (f *facetFilter) query(dir string) Query {
+	var res queryAnd
+	for i := range f {
+		if f[i] == nil {
+			continue
+		}
+
+		values := make([]string, 0, len(f[i]))
+		for v := range f[i] {
+			values = append(values, v)
+		}
+		sort.Strings(values)
+
+		var or queryOr
+		for _, v := range values {
+			switch i {
+			case facetExt:
+				or = append(or, queryExt{v})
+			case facetDir:
+				or = append(or, queryPath(fold(dir)+v+"/"))
+			case facetSize:
+				lo, hi, _ := bucketRange(v)
+				or = append(or, &queryRange{col: "size", lo: lo, hi: hi})
+			case facetYear:
+				y, _ := strconv.Atoi(v)
+				t := time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+				or = append(or, &queryRange{col: "mtime", lo: t.Unix(), hi: t.AddDate(1, 0, 0).Unix()})
+			}
+		}
+		res = append(res, or)
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// bucketRange returns the interval [lo, hi) of the sizes in bucket name
+func bucketRange(name string) (int64, int64, bool) {
+	lo := int64(0)
+	for _, b := range sizeBuckets {
+		if fold(b.name) == name {
+			return lo, b.hi, true
+		}
+		lo = b.hi
+	}
+	return 0, 0, false
+}
+
+// facetKeys returns the facet values of entry name (relative to the searched directory), empty if it has none
+func facetKeys(name string, dir bool, size int64, mtime int64) [facetCount]string {
+	var k [facetCount]string
+	if i := strings.IndexByte(name, '/'); i > 0 {
+		k[facetDir] = name[:i]
+	}
+	k[facetYear] = strconv.Itoa(time.Unix(mtime, 0).UTC().Year())
+	if dir {
+		return k
+	}
+
+	k[facetExt] = strings.TrimPrefix(path.Ext(name), ".")
+	for _, b := range sizeBuckets {
+		if size < b.hi {
+			k[facetSize] = b.name
+			break
+		}
+	}
+	return k
+}
+
+// match reports whether the entry with (folded) facet values k is selected by all facets of f but skip
+func (f *facetFilter) match(k *[facetCount]string, skip int) bool {
+	for i := range f {
+		if i != skip && f[i] != nil && !f[i][k[i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// facets counts the facets of the entries in the directories matching glob p that match q, returning
+// them with the number of entries filter selects. For every facet, the entries are narrowed by the
+// other facets of filter only, so that its alternatives remain visible.
+func (fs *CachedFS) facets(ctx context.Context, p string, dir string, q Query, substr bool, filter *facetFilter) (*SearchResults, int64, error) {
+	where, args := compileQuery(q, substr)
+	rows, err := fs.db.QueryContext(ctx, "SELECT dirs.path, files.name, files.dir, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.root IN (SELECT rowid FROM dirs WHERE path GLOB ?) AND "+where, append([]interface{}{p}, args...)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var matched int64
+	var counts [facetCount]map[string]int64
+	var names [facetCount]map[string]string
+	for i := range counts {
+		counts[i] = make(map[string]int64)
+		names[i] = make(map[string]string)
+	}
+
+	res := SearchResults{Facets: &Facets{}}
+	for rows.Next() {
+		var root string
+		var name string
+		var isDir bool
+		var size int64
+		var mtime int64
+		if err := rows.Scan(&root, &name, &isDir, &size, &mtime); err != nil {
+			return nil, 0, err
+		}
+
+		matched++
+		keys := facetKeys(root[len(dir):]+name, isDir, size, mtime)
+		folded := keys
+		for i := range folded {
+			folded[i] = fold(folded[i])
+		}
+		if filter.match(&folded, -1) {
+			res.Total++
+		}
+		for i, k := range folded {
+			if k == "" || !filter.match(&folded, i) {
+				continue
+			}
+			if _, ok := names[i][k]; !ok {
+				names[i][k] = keys[i]
+			}
+			counts[i][k]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	for i, f := range []*[]Facet{&res.Facets.Ext, &res.Facets.Dir, &res.Facets.Size, &res.Facets.Year} {
+		*f = make([]Facet, 0, len(counts[i]))
+		for k, n := range counts[i] {
+			v := names[i][k]
+			if i == facetExt {
+				v = k
+			}
+			*f = append(*f, Facet{Value: v, Count: n})
+		}
+		sortFacets(i, *f)
+		if len(*f) > facetValues {
+			*f = (*f)[:facetValues]
+		}
+	}
+
+	return &res, matched, nil
+}
+
+// sortFacets sorts the values of facet i: sizes ascending, years descending and others by count
+func sortFacets(i int, f []Facet) {
+	sort.Slice(f, func(a, b int) bool {
+		switch i {
+		case facetSize:
+			la, _, _ := bucketRange(fold(f[a].Value))
+			lb, _, _ := bucketRange(fold(f[b].Value))
+			return la < lb
+		case facetYear:
+			return f[a].Value > f[b].Value
+		}
+		if f[a].Count != f[b].Count {
+			return f[a].Count > f[b].Count
+		}
+		return f[a].Value < f[b].Value
+	})
+}
+
+// facetSearch searches like search, narrowing the results to the entries that filter selects, and
+// counts the facets of all entries (in directory dir) that match q
+func (fs *CachedFS) facetSearch(ctx context.Context, p string, dir string, q Query, fuzzy bool, filter *facetFilter) (*SearchResults, error) {
+	if fuzzy {
+		if err := fs.resolve(ctx, q); err != nil {
+			return nil, err
+		}
+	}
+
+	terms := rankTerms(q)
+	substr := false
+	res, matched, err := fs.facets(ctx, p, dir, q, substr, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// No token matches, fall back to substrings (for the facets and the results alike)
+	if matched == 0 && len(terms) > 0 && !fuzzy {
+		substr = true
+		if res, _, err = fs.facets(ctx, p, dir, q, substr, filter); err != nil {
+			return nil, err
+		}
+	}
+
+	if fq := filter.query(dir); fq != nil {
+		q = queryAnd{q, fq}
+	}
+
+	if res.Files, err = fs.find(ctx, p, len(dir), q, terms, substr); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,95 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFacets(t *testing.T) {
+	fs, root := newTestFS(t, "ubuntu/22.04/", "Debian/")
+	for name, size := range map[string]int{
+		"ubuntu/22.04/ubuntu-22.04-server.iso": 2 << 10,
+		"ubuntu/22.04/ubuntu-22.04.txt":        10,
+		"Debian/debian-server.ISO":             2 << 20,
+		"server.txt":                           0,
+	} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name == "server.txt" {
+			old := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fill(t, fs)
+
+	search := func(q string, params string) *SearchResults {
+		t.Helper()
+		n, err := parseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, _ := url.ParseQuery(params)
+		f, err := parseFacets(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := fs.facetSearch(context.Background(), "/*", "/", n, false, &f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := search("server", "")
+	if res.Total != 3 || len(res.Files) != 3 {
+		t.Fatalf("Unexpected results %+v\n", res)
+	}
+	if f := res.Facets.Ext; len(f) != 2 || f[0] != (Facet{"iso", 2}) || f[1] != (Facet{"txt", 1}) {
+		t.Errorf("Unexpected ext facet %+v\n", f)
+	}
+	if f := res.Facets.Dir; len(f) != 2 || f[0] != (Facet{"Debian", 1}) || f[1] != (Facet{"ubuntu", 1}) {
+		t.Errorf("Unexpected dir facet %+v\n", f)
+	}
+	if f := res.Facets.Size; len(f) != 3 || f[0] != (Facet{"0-1K", 1}) || f[2] != (Facet{"1M-100M", 1}) {
+		t.Errorf("Unexpected size facet %+v\n", f)
+	}
+	if f := res.Facets.Year; len(f) != 2 || f[1] != (Facet{"2019", 1}) {
+		t.Errorf("Unexpected year facet %+v\n", f)
+	}
+
+	// Filters narrow the results, and the other facets
+	res = search("server", "ext=ISO&dir=ubuntu,debian")
+	if res.Total != 2 || len(res.Files) != 2 || len(res.Facets.Ext) != 1 || len(res.Facets.Dir) != 2 || len(res.Facets.Year) != 1 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	res = search("server", "size=1K-1M&year=2019")
+	if res.Total != 0 || len(res.Files) != 0 || len(res.Facets.Size) != 1 || res.Facets.Size[0].Value != "0-1K" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	// Substring fallback
+	res = search("erve", "dir=ubuntu")
+	if res.Total != 1 || len(res.Files) != 1 || res.Files[0].Name != "ubuntu/22.04/ubuntu-22.04-server.iso" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	for _, p := range []string{"size=1K", "year=abc", "year=0"} {
+		v, _ := url.ParseQuery(p)
+		if _, err := parseFacets(v); err != ErrQuery {
+			t.Errorf("%s: Expected error, got %v\n", p, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+)
+
+// Number of entries in a feed
+const feedItems = 50
+
+type feedItem struct {
+	Path  string
+	Size  int64
+	Mtime time.Time
+}
+
+// Atom feed document (RFC 4287)
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  string      `xml:"author>name"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+}
+
+// RSS 2.0 feed document
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Updated     string    `xml:"lastBuildDate,omitempty"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title     string       `xml:"title"`
+	Link      string       `xml:"link"`
+	GUID      string       `xml:"guid"`
+	PubDate   string       `xml:"pubDate"`
+	Enclosure rssEnclosure `xml:"enclosure"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+// feedItems returns the newest files in subtree dir matching search (if not nil)
+func (fs *CachedFS) feedItems(ctx context.Context, dir string, search Query) ([]feedItem, error) {
+	where, args := "1", []interface{}{}
+	if search != nil {
+		where, args = compileQuery(search, false)
+	}
+
+	rows, err := fs.db.QueryContext(ctx, "SELECT dirs.path, files.name, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.root IN (SELECT rowid FROM dirs WHERE path GLOB ?) AND NOT files.dir AND "+where+" ORDER BY files.mtime DESC LIMIT ?", append(append([]interface{}{escapeGlob(dir) + "*"}, args...), feedItems)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]feedItem, 0)
+	for rows.Next() {
+		var root, name string
+		var size, mtime sql.NullInt64
+		if err := rows.Scan(&root, &name, &size, &mtime); err != nil {
+			return nil, err
+		}
+		res = append(res, feedItem{Path: root + name, Size: size.Int64, Mtime: time.Unix(mtime.Int64, 0).UTC()})
+	}
+
+	return res, rows.Err()
+}
+
+func contentType(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// Feed serves the newest files in a subtree (optionally matching search q) as an Atom or RSS (format=rss) feed
+func (fs *CachedFS) Feed(w http.ResponseWriter, r *http.Request) {
+	if !fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	base, err := url.Parse("https://" + r.Host)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	link := func(p string) string {
+		u := *base
+		u.Path = p
+		return u.String()
+	}
+
+	dir := cleanPath(r.URL.Path)
+	q := r.URL.Query().Get("q")
+	search, err := parseQuery(q)
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var id, ts int64
+	if err := fs.qd.QueryRowContext(ctx, escapeGlob(dir)).Scan(&id, &ts); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	items, err := fs.feedItems(ctx, dir, search)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	title := r.Host + dir
+	home := link(dir)
+	if q != "" {
+		title += " - " + q
+		home += "?r=1&q=" + url.QueryEscape(q)
+	}
+
+	self := link("/feed" + dir)
+	if r.URL.RawQuery != "" {
+		self += "?" + r.URL.RawQuery
+	}
+
+	var updated time.Time
+	if len(items) > 0 {
+		updated = items[0].Mtime
+	} else {
+		updated = time.Unix(ts, 0).UTC()
+	}
+
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Header().Set("Last-Modified", updated.Format(http.TimeFormat))
+
+	if r.URL.Query().Get("format") == "rss" {
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:       title,
+				Link:        home,
+				Description: "Newest files in " + title,
+				Updated:     updated.Format(time.RFC1123Z),
+				Items:       make([]rssItem, 0, len(items)),
+			},
+		}
+		for _, f := range items {
+			dl := link("/dl" + f.Path)
+			feed.Channel.Items = append(feed.Channel.Items, rssItem{
+				Title:     f.Path[len(dir):],
+				Link:      link(path.Dir(f.Path)),
+				GUID:      dl,
+				PubDate:   f.Mtime.Format(time.RFC1123Z),
+				Enclosure: rssEnclosure{URL: dl, Length: f.Size, Type: contentType(f.Path)},
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(&feed)
+		return
+	}
+
+	feed := atomFeed{
+		ID:      self,
+		Title:   title,
+		Updated: updated.Format(time.RFC3339),
+		Author:  r.Host,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: self},
+			{Rel: "alternate", Type: "text/html", Href: home},
+		},
+		Entries: make([]atomEntry, 0, len(items)),
+	}
+	for _, f := range items {
+		dl := link("/dl" + f.Path)
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      dl,
+			Title:   f.Path[len(dir):],
+			Updated: f.Mtime.Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "alternate", Type: "text/html", Href: link(path.Dir(f.Path))},
+				{Rel: "enclosure", Type: contentType(f.Path), Length: f.Size, Href: dl},
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&feed)
+}
@@ -0,0 +1,99 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeed(t *testing.T) {
+	fs, root := newTestFS(t, "pub/sub/", "other/")
+	now := time.Now().Truncate(time.Second).UTC()
+	for name, age := range map[string]time.Duration{"pub/old.png": 3, "pub/sub/new file.pdf": 1, "pub/mid.xyz": 2, "other/x.pdf": 0} {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-age * time.Hour)
+		if err := os.Chtimes(p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fill(t, fs)
+
+	get := func(u string, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "http://example.com"+u, nil)
+		http.StripPrefix("/feed", http.HandlerFunc(fs.Feed)).ServeHTTP(w, r)
+		if w.Code != status {
+			t.Fatalf("%s: Expected status %d, got %d\n", u, status, w.Code)
+		}
+		return w
+	}
+
+	// Atom, newest first with enclosures
+	w := get("/feed/pub/", http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("Unexpected content type %q\n", ct)
+	}
+	var atom atomFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &atom); err != nil {
+		t.Fatal(err)
+	}
+	if atom.Title != "example.com/pub/" || atom.Updated != now.Add(-time.Hour).Format(time.RFC3339) || len(atom.Entries) != 3 {
+		t.Fatalf("Unexpected feed %+v\n", atom)
+	}
+	if atom.Links[0] != (atomLink{Rel: "self", Type: "application/atom+xml", Href: "https://example.com/feed/pub/"}) {
+		t.Errorf("Unexpected self link %+v\n", atom.Links[0])
+	}
+	want := []atomEntry{
+		{ID: "https://example.com/dl/pub/sub/new%20file.pdf", Title: "sub/new file.pdf", Updated: now.Add(-time.Hour).Format(time.RFC3339), Links: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: "https://example.com/pub/sub"},
+			{Rel: "enclosure", Type: "application/pdf", Length: int64(len("pub/sub/new file.pdf")), Href: "https://example.com/dl/pub/sub/new%20file.pdf"},
+		}},
+		{ID: "https://example.com/dl/pub/mid.xyz", Title: "mid.xyz", Updated: now.Add(-2 * time.Hour).Format(time.RFC3339), Links: []atomLink{
+			{Rel: "alternate", Type: "text/html", Href: "https://example.com/pub"},
+			{Rel: "enclosure", Type: "application/octet-stream", Length: int64(len("pub/mid.xyz")), Href: "https://example.com/dl/pub/mid.xyz"},
+		}},
+	}
+	if !reflect.DeepEqual(atom.Entries[:2], want) {
+		t.Errorf("Expected entries\n%+v\ngot\n%+v\n", want, atom.Entries[:2])
+	}
+
+	// RSS, limited to a search
+	w = get("/feed/pub/?format=rss&q=pdf", http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/rss+xml; charset=utf-8" {
+		t.Fatalf("Unexpected content type %q\n", ct)
+	}
+	var rss rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &rss); err != nil {
+		t.Fatal(err)
+	}
+	if rss.Version != "2.0" || rss.Channel.Title != "example.com/pub/ - pdf" || rss.Channel.Link != "https://example.com/pub/?r=1&q=pdf" || len(rss.Channel.Items) != 1 {
+		t.Fatalf("Unexpected feed %+v\n", rss)
+	}
+	item := rss.Channel.Items[0]
+	if item.Title != "sub/new file.pdf" || item.PubDate != now.Add(-time.Hour).Format(time.RFC1123Z) || item.GUID != "https://example.com/dl/pub/sub/new%20file.pdf" {
+		t.Errorf("Unexpected item %+v\n", item)
+	}
+	if item.Enclosure != (rssEnclosure{URL: item.GUID, Length: int64(len("pub/sub/new file.pdf")), Type: "application/pdf"}) {
+		t.Errorf("Unexpected enclosure %+v\n", item.Enclosure)
+	}
+	if !strings.HasPrefix(w.Body.String(), xml.Header) {
+		t.Error("Expected XML declaration")
+	}
+
+	get("/feed/missing/", http.StatusNotFound)
+}
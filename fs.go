@@ -8,6 +8,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"os"
@@ -16,10 +17,11 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/nielsAD/autoindex/walk"
 )
 
@@ -30,12 +32,58 @@ type CachedFS struct {
 	qs      *sql.Stmt
 	db      *sql.DB
 	dbr     int32
+	dbn     int64
+	shrink  int32
+	gen     int64
 	dbp     string
+	wlock   chan struct{}
+	avail   availability
+	pending sync.Map
+
+	lmu        sync.RWMutex
+	listeners  []func(gen int64)
+	clisteners []func(gen int64)
+	slisteners []func(e *SearchEvent)
+	results    *resultCache
+
 	Root    string
 	Cached  bool
 	Timeout time.Duration
+
+	// Keep log of changes between refreshes for this long (0 to disable)
+	Retention time.Duration
+
+	// Re-read cached directories older than Stale when visited (0 to disable)
+	Stale      time.Duration
+	StaleAsync bool
+
+	// Safeguards against publishing an index of a missing backing store
+	Sentinel   string
+	Mountpoint bool
+	MaxShrink  float64
+
+	// Index the text of files with these extensions, up to ContentSize bytes (0 for no limit)
+	Content     []string
+	ContentSize int64
+
+	// Keep search results of the current generation in memory, up to CacheSize bytes (0 to disable)
+	CacheSize int64
 }
 
+func init() {
+	sql.Register("sqlite3_autoindex", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterCollation("paths", comparePaths); err != nil {
+				return err
+			}
+			return conn.RegisterFunc("regexp", sqlRegexp, true)
+		},
+	})
+}
+
+// Bump whenever the layout of the database changes
+const schemaVersion = 10
+
 // New CachedFS
 func New(dbp string, root string) (*CachedFS, error) {
 	r, err := filepath.Abs(root)
@@ -43,14 +91,58 @@ func New(dbp string, root string) (*CachedFS, error) {
 		return nil, err
 	}
 
-	db, err := sql.Open("sqlite3", dbp)
+	db, err := sql.Open("sqlite3_autoindex", dbp)
 	if err != nil {
 		return nil, err
 	}
 
+	var ver int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&ver); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Discard outdated index, the next Fill will rebuild it
+	if ver != schemaVersion {
+		if _, err := db.Exec(fmt.Sprintf(`
+			DROP TABLE IF EXISTS dirs;
+			DROP TABLE IF EXISTS files;
+			DROP TABLE IF EXISTS changes;
+			DROP TABLE IF EXISTS generations;
+			DROP TABLE IF EXISTS tokens;
+			DROP TABLE IF EXISTS words;
+			DROP TABLE IF EXISTS trigrams;
+			DROP TABLE IF EXISTS ctokens;
+			DROP TABLE IF EXISTS hashes;
+			DROP TABLE IF EXISTS webhooks;
+			PRAGMA user_version = %d
+		`, schemaVersion)); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
 	if _, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS dirs (path TEXT);
-		CREATE TABLE IF NOT EXISTS files (root INTEGER, name TEXT, dir BOOLEAN)
+		CREATE TABLE IF NOT EXISTS dirs (path TEXT, search TEXT, scanned INTEGER, size INTEGER, nfiles INTEGER, ndirs INTEGER, newest INTEGER, exts TEXT, partial BOOLEAN);
+		CREATE TABLE IF NOT EXISTS files (root INTEGER, name TEXT, search TEXT, dir BOOLEAN, size INTEGER, mtime INTEGER);
+		CREATE TABLE IF NOT EXISTS generations (gen INTEGER PRIMARY KEY, time INTEGER, scope TEXT, added INTEGER, removed INTEGER, modified INTEGER);
+		CREATE TABLE IF NOT EXISTS changes (gen INTEGER, time INTEGER, root TEXT, name TEXT, dir BOOLEAN, op TEXT, size INTEGER, mtime INTEGER, osize INTEGER, omtime INTEGER);
+		CREATE INDEX IF NOT EXISTS idx_changes ON changes (root);
+		CREATE INDEX IF NOT EXISTS idx_changes_time ON changes (time);
+		CREATE TABLE IF NOT EXISTS hashes (path TEXT PRIMARY KEY, size INTEGER, mtime INTEGER, hash TEXT, file TEXT);
+		CREATE INDEX IF NOT EXISTS idx_dirs_search ON dirs (search);
+		CREATE INDEX IF NOT EXISTS idx_files_search ON files (search);
+		CREATE TABLE IF NOT EXISTS tokens (token TEXT, file INTEGER);
+		CREATE INDEX IF NOT EXISTS idx_tokens ON tokens (token);
+		CREATE INDEX IF NOT EXISTS idx_tokens_file ON tokens (file);
+		CREATE TABLE IF NOT EXISTS words (word TEXT PRIMARY KEY);
+		CREATE TABLE IF NOT EXISTS trigrams (gram TEXT, word TEXT);
+		CREATE INDEX IF NOT EXISTS idx_trigrams ON trigrams (gram);
+		CREATE TABLE IF NOT EXISTS content (path TEXT PRIMARY KEY, size INTEGER, mtime INTEGER, text TEXT, search TEXT, seen INTEGER);
+		CREATE TABLE IF NOT EXISTS ctokens (token TEXT, file INTEGER);
+		CREATE INDEX IF NOT EXISTS idx_ctokens ON ctokens (token);
+		CREATE INDEX IF NOT EXISTS idx_ctokens_file ON ctokens (file);
+		CREATE TRIGGER IF NOT EXISTS trg_tokens AFTER DELETE ON files BEGIN DELETE FROM tokens WHERE file = old.rowid; DELETE FROM ctokens WHERE file = old.rowid; END;
 	`); err != nil {
 		db.Close()
 		return nil, err
@@ -62,7 +154,7 @@ func New(dbp string, root string) (*CachedFS, error) {
 		return nil, err
 	}
 
-	qd, err := db.Prepare("SELECT dirs.rowid FROM dirs WHERE path GLOB ? LIMIT 1")
+	qd, err := db.Prepare("SELECT dirs.rowid, dirs.scanned FROM dirs WHERE path GLOB ? LIMIT 1")
 	if err != nil {
 		db.Close()
 		return nil, err
@@ -75,77 +167,173 @@ func New(dbp string, root string) (*CachedFS, error) {
 	}
 
 	fs := CachedFS{
-		ql:   ql,
-		qd:   qd,
-		qs:   qs,
-		db:   db,
-		dbp:  dbp,
-		Root: r,
+		ql:      ql,
+		qd:      qd,
+		qs:      qs,
+		db:      db,
+		dbp:     dbp,
+		wlock:   make(chan struct{}, 1),
+		results: newResultCache(),
+		Root:    r,
+	}
+
+	if err := db.QueryRow("SELECT IFNULL(MAX(gen), 0) FROM generations").Scan(&fs.gen); err != nil {
+		db.Close()
+		return nil, err
 	}
 
+	// Search results are only valid for the generation they were found in
+	fs.results.purge(fs.gen)
+	fs.OnPublish(fs.results.purge)
+
 	// Check if database already has root entry
-	var id int64
-	if fs.qd.QueryRow("/").Scan(&id) == nil {
+	var id, ts int64
+	if fs.qd.QueryRow("/").Scan(&id, &ts) == nil {
 		fs.dbr++
+		if err := db.QueryRow("SELECT COUNT(*) FROM files").Scan(&fs.dbn); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
 	return &fs, nil
 }
 
+// lock acquires the write lock, giving up when ctx is done
+func (fs *CachedFS) lock(ctx context.Context) error {
+	select {
+	case fs.wlock <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (fs *CachedFS) unlock() {
+	<-fs.wlock
+}
+
 // Close closes the database, releasing any open resources.
 func (fs *CachedFS) Close() error {
 	return fs.db.Close()
 }
 
 const (
-	insDir  = "INSERT INTO dirs_tmp (path) VALUES (?)"
-	insFile = "INSERT INTO files_tmp (root, name, dir) VALUES (?, ?, ?)"
+	insDir  = "INSERT INTO dirs_tmp (path, search, scanned) VALUES (?, ?, ?)"
+	insFile = "INSERT INTO files_tmp (root, name, search, dir, size, mtime) VALUES (?, ?, ?, ?, ?, ?)"
 )
 
-// Fill database
-func (fs *CachedFS) Fill() (int, error) {
-	if _, err := fs.db.Exec(`
+// createTmp (re)creates the staging tables that are filled by scan
+func (fs *CachedFS) createTmp() error {
+	_, err := fs.db.Exec(`
 		DROP TABLE IF EXISTS dirs_tmp;
 		DROP TABLE IF EXISTS files_tmp;
-		CREATE TABLE dirs_tmp (path TEXT);
-		CREATE TABLE files_tmp (root INTEGER, name TEXT, dir BOOLEAN)
-	`); err != nil {
-		return 0, err
+		CREATE TABLE dirs_tmp (path TEXT, search TEXT, scanned INTEGER, size INTEGER, nfiles INTEGER, ndirs INTEGER, newest INTEGER, exts TEXT, partial BOOLEAN);
+		CREATE TABLE files_tmp (root INTEGER, name TEXT, search TEXT, dir BOOLEAN, size INTEGER, mtime INTEGER)
+	`)
+	return err
+}
+
+// insideRoot reports whether symlink r resolves to a path within root
+func (fs *CachedFS) insideRoot(r string) (bool, error) {
+	e, err := filepath.EvalSymlinks(r)
+	if err != nil {
+		return false, err
+	}
+	a, err := filepath.Abs(e)
+	if err != nil {
+		return false, err
 	}
 
-	tx, err := fs.db.Begin()
+	root := fs.Root
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(a, root), nil
+}
+
+// stat returns the size and modification time of the file at r (zero if unavailable)
+func stat(r string) (int64, int64) {
+	fi, err := os.Stat(r)
 	if err != nil {
-		return 0, err
+		return 0, 0
+	}
+	return fi.Size(), fi.ModTime().Unix()
+}
+
+// scanner inserts directory entries into the staging tables
+type scanner struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	idir  *sql.Stmt
+	ifile *sql.Stmt
+	batch int
+	cnt   int
+}
+
+func (s *scanner) begin() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
 	}
 	idir, err := tx.Prepare(insDir)
 	if err != nil {
-		return 0, err
+		tx.Rollback()
+		return err
 	}
 	ifile, err := tx.Prepare(insFile)
 	if err != nil {
-		return 0, err
+		tx.Rollback()
+		return err
+	}
+
+	s.tx = tx
+	s.idir = idir
+	s.ifile = ifile
+	return nil
+}
+
+// next counts an inserted entry, committing the transaction every batch entries
+func (s *scanner) next() error {
+	s.cnt++
+	if s.batch == 0 || s.cnt%s.batch != 0 {
+		return nil
+	}
+
+	if err := s.tx.Commit(); err != nil {
+		return err
+	}
+	return s.begin()
+}
+
+// scan walks the directory at sub (relative to root) and inserts its
+// contents into the staging tables. The returned scanner holds the open
+// transaction and the number of inserted files.
+// If batch is non-zero, the transaction is committed every batch entries.
+func (fs *CachedFS) scan(sub string, batch int) (*scanner, error) {
+	s := scanner{db: fs.db, batch: batch}
+	if err := s.begin(); err != nil {
+		return nil, err
 	}
 
-	cnt := 0
+	skip := true
+	now := time.Now().Unix()
 	dirs := []int64{0}
-	root := fs.Root
 	trim := len(fs.Root)
 
-	if strings.HasSuffix(root, string(filepath.Separator)) {
+	if strings.HasSuffix(fs.Root, string(filepath.Separator)) {
 		trim--
-	} else {
-		root += string(filepath.Separator)
 	}
 
-	err = walk.Walk(fs.Root, &walk.Options{
+	err := walk.Walk(filepath.Join(fs.Root, filepath.FromSlash(sub)), &walk.Options{
 		Error: func(r string, e *walk.Dirent, err error) error {
 			logErr.Printf("Error iterating \"%s\": %s\n", r, err.Error())
 			return nil
 		},
 		Visit: func(r string, e *walk.Dirent) error {
 			// Skip root
-			if cnt == 0 {
-				cnt++
+			if skip {
+				skip = false
 				return nil
 			}
 
@@ -154,30 +342,12 @@ func (fs *CachedFS) Fill() (int, error) {
 				return nil
 			}
 
-			if _, err := ifile.Exec(dirs[len(dirs)-1], n, e.IsDir()); err != nil {
+			size, mtime := stat(r)
+			if _, err := s.ifile.Exec(dirs[len(dirs)-1], n, fold(n), e.IsDir(), size, mtime); err != nil {
 				return err
 			}
 
-			cnt++
-			if cnt%16384 == 0 {
-				if err := tx.Commit(); err != nil {
-					return err
-				}
-				tx, err = fs.db.Begin()
-				if err != nil {
-					return err
-				}
-				idir, err = tx.Prepare(insDir)
-				if err != nil {
-					return err
-				}
-				ifile, err = tx.Prepare(insFile)
-				if err != nil {
-					return err
-				}
-			}
-
-			return nil
+			return s.next()
 		},
 		Enter: func(r string, e *walk.Dirent) error {
 			if strings.HasPrefix(e.Name(), ".") {
@@ -185,15 +355,11 @@ func (fs *CachedFS) Fill() (int, error) {
 			}
 
 			if e.IsSymlink() {
-				e, err := filepath.EvalSymlinks(r)
-				if err != nil {
-					return err
-				}
-				a, err := filepath.Abs(e)
+				in, err := fs.insideRoot(r)
 				if err != nil {
 					return err
 				}
-				if strings.HasPrefix(a, root) {
+				if in {
 					logErr.Printf("Skipping symlink relative to root (%s)\n", r)
 					return filepath.SkipDir
 				}
@@ -204,7 +370,7 @@ func (fs *CachedFS) Fill() (int, error) {
 				dir += "/"
 			}
 
-			row, err := idir.Exec(dir)
+			row, err := s.idir.Exec(dir, fold(dir), now)
 			if err != nil {
 				return err
 			}
@@ -223,10 +389,59 @@ func (fs *CachedFS) Fill() (int, error) {
 		},
 	})
 	if err != nil {
-		tx.Rollback()
+		s.tx.Rollback()
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// Fill database
+func (fs *CachedFS) Fill() (int, error) {
+	fs.lock(context.Background())
+	defer fs.unlock()
+
+	if err := fs.Available(); err != nil {
+		return 0, err
+	}
+	if err := fs.createTmp(); err != nil {
+		return 0, err
+	}
+
+	s, err := fs.scan("/", 16384)
+	if err != nil {
+		return 0, err
+	}
+
+	err = fs.checkShrink(atomic.LoadInt64(&fs.dbn), int64(s.cnt))
+	if err == nil {
+		// Backing store may have disappeared while walking
+		err = fs.Available()
+	}
+	if err != nil {
+		s.tx.Rollback()
 		return 0, err
 	}
 
+	if err := fs.swap(s.tx, s.cnt); err != nil {
+		return 0, err
+	}
+
+	return s.cnt + 1, nil
+}
+
+// swap replaces the index by the staging tables (holding cnt entries) in
+// transaction tx, and publishes the result as a new generation
+func (fs *CachedFS) swap(tx *sql.Tx, cnt int) error {
+	// Nothing to compare against on the very first run
+	track := fs.Retention > 0 && fs.DBReady()
+	if track {
+		if err := snapshot(tx, "diff_old", "1"); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	if _, err := tx.Exec(`
 		DROP TABLE IF EXISTS dirs;
 		DROP TABLE IF EXISTS files;
@@ -234,18 +449,71 @@ func (fs *CachedFS) Fill() (int, error) {
 		ALTER TABLE files_tmp RENAME TO files;
 		CREATE INDEX idx_dirs ON dirs (path);
 		CREATE INDEX idx_files ON files (root);
+		CREATE INDEX idx_dirs_search ON dirs (search);
+		CREATE INDEX idx_files_search ON files (search);
+		DELETE FROM tokens;
+		DELETE FROM words;
+		DELETE FROM trigrams;
+		DELETE FROM ctokens;
+		CREATE TRIGGER IF NOT EXISTS trg_tokens AFTER DELETE ON files BEGIN DELETE FROM tokens WHERE file = old.rowid; DELETE FROM ctokens WHERE file = old.rowid; END
 	`); err != nil {
-		return 0, err
+		tx.Rollback()
+		return err
+	}
+
+	if err := indexTokens(tx, "1"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := fs.indexContent(tx, true, "1"); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := aggregate(tx, "/", true); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	gen, err := fs.record(tx, "/", track, "1")
+	if err != nil {
+		tx.Rollback()
+		return err
 	}
 
 	if err := tx.Commit(); err != nil {
-		return 0, err
+		return err
 	}
 
 	fs.db.Exec("VACUUM; PRAGMA shrink_memory")
+	atomic.StoreInt64(&fs.dbn, int64(cnt))
 	atomic.AddInt32(&fs.dbr, 1)
+	fs.publish(gen, false)
 
-	return cnt, nil
+	return nil
+}
+
+// checkShrink refuses to replace old entries by n entries if it shrinks the index beyond MaxShrink,
+// unless acknowledged with AllowShrink
+func (fs *CachedFS) checkShrink(old int64, n int64) error {
+	if fs.MaxShrink <= 0 || old == 0 || n >= old {
+		return nil
+	}
+
+	if shrink := float64(old-n) / float64(old); shrink > fs.MaxShrink {
+		if atomic.CompareAndSwapInt32(&fs.shrink, 1, 0) {
+			logErr.Printf("Shrinking index from %d to %d entries (%.0f%%), as acknowledged\n", old, n, shrink*100)
+			return nil
+		}
+		return fmt.Errorf("refusing to shrink index from %d to %d entries (%.0f%%)", old, n, shrink*100)
+	}
+	return nil
+}
+
+// AllowShrink lets the next update that would be refused by MaxShrink through (once)
+func (fs *CachedFS) AllowShrink() {
+	atomic.StoreInt32(&fs.shrink, 1)
 }
 
 // DBReady returns whether the DB is ready for querying
@@ -254,36 +522,14 @@ func (fs *CachedFS) DBReady() bool {
 }
 
 var (
-	escGlob  = regexp.MustCompile(`[][*?]`)
-	escLike  = regexp.MustCompile("[%_`]")
-	escSpace = regexp.MustCompile(`\s+`)
+	escGlob = regexp.MustCompile(`[][*?]`)
+	escLike = regexp.MustCompile("[%_`]")
 )
 
 func escapeGlob(s string) string {
 	return escGlob.ReplaceAllStringFunc(s, func(m string) string { return "[" + m + "]" })
 }
 
-func escapeLike(s string) string {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return "%"
-	}
-
-	s = escLike.ReplaceAllStringFunc(s, func(m string) string { return "`" + m })
-	s = escSpace.ReplaceAllString(s, "%")
-	return "%" + s + "%"
-}
-
-func escapeRegex(s string) string {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return ".*"
-	}
-	s = regexp.QuoteMeta(s)
-	s = escSpace.ReplaceAllString(s, ".*")
-	return "(?i).*" + s + ".*"
-}
-
 func cleanPath(p string) string {
 	if !strings.HasPrefix(p, "/") {
 		p = "/" + p
@@ -299,6 +545,17 @@ func cleanPath(p string) string {
 type File struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
+	Gone bool   `json:"gone,omitempty"`
+
+	// Relevance of search results, with the matched ranges of Name (in UTF-16 code units)
+	Score   float64  `json:"score,omitempty"`
+	Matches [][2]int `json:"matches,omitempty"`
+
+	// Text around the first match of a content search
+	Snippet string `json:"snippet,omitempty"`
+
+	// Recursive totals of directories
+	*Aggregate
 }
 
 // Files list (sortable)
@@ -319,19 +576,35 @@ func (fs *CachedFS) serveCache(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
 	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
 	defer cancel()
 
-	p := cleanPath(r.URL.Path)
-	trim := len(p)
+	mode := r.URL.Query().Get("mode")
+	q := r.URL.Query().Get("q")
+	query, err := parseSearch(q, mode)
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseFacets(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	_, faceted := r.URL.Query()["facets"]
 
-	p = escapeGlob(p)
-	if r.URL.Query().Get("r") != "" {
+	dir := cleanPath(r.URL.Path)
+	trim := len(dir)
+	recursive := r.URL.Query().Get("r") != ""
+
+	p := escapeGlob(dir)
+	if recursive {
 		p += "*"
 	}
 
-	var id int64
-	if err := fs.qd.QueryRowContext(ctx, p).Scan(&id); err == sql.ErrNoRows {
+	var id, ts int64
+	if err := fs.qd.QueryRowContext(ctx, p).Scan(&id, &ts); err == sql.ErrNoRows {
 		http.NotFound(w, r)
 		return
 	} else if err != nil {
@@ -339,23 +612,116 @@ func (fs *CachedFS) serveCache(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := make(Files, 0)
-	search := escapeLike(r.URL.Query().Get("q"))
+	if fs.Stale > 0 && !recursive && time.Since(time.Unix(ts, 0)) > fs.Stale {
+		vctx, cancel := context.WithTimeout(ctx, fs.Timeout/2)
+		fs.visit(vctx, dir)
+		cancel()
+	}
 
-	rows, err := fs.qs.QueryContext(ctx, p, search)
+	var resp Files
+	var res *SearchResults
+	if query != nil {
+		res, err = fs.cachedSearch(ctx, w, p, dir, mode, query, &filter, faceted)
+		if err == nil {
+			resp = res.Files
+		}
+		if err == nil && len(resp) == 0 {
+			var alts []string
+			if alts, err = fs.suggest(ctx, q, query); err == nil {
+				for _, a := range alts {
+					w.Header().Add("X-Did-You-Mean", url.PathEscape(a))
+				}
+			}
+		}
+	} else {
+		resp, err = fs.list(ctx, p, trim)
+		sort.Sort(resp)
+	}
 	if err != nil {
 		logError(http.StatusInternalServerError, err, w, r)
 		return
 	}
+
+	if err := fs.attachAggregates(ctx, dir, resp); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	if query != nil {
+		fs.searched(r, start, dir, res.Total)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	if faceted && res != nil {
+		json.NewEncoder(w).Encode(res)
+	} else {
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// cachedSearch returns the (faceted) search results for q in directory dir (matching glob p), from the
+// result cache if possible. The X-Cache header of w tells whether they were.
+func (fs *CachedFS) cachedSearch(ctx context.Context, w http.ResponseWriter, p string, dir string, mode string, q Query, filter *facetFilter, faceted bool) (*SearchResults, error) {
+	gen := fs.Generation()
+	key := cacheKey(gen, p, mode, q, filter, faceted)
+	if fs.CacheSize > 0 {
+		if res := fs.results.get(key); res != nil {
+			w.Header().Set("X-Cache", "HIT")
+			return res, nil
+		}
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	var res *SearchResults
+	var err error
+	if faceted || filter.query(dir) != nil {
+		if res, err = fs.facetSearch(ctx, p, dir, q, mode == "fuzzy", filter); err != nil {
+			return nil, err
+		}
+		if !faceted {
+			res.Facets = nil
+		}
+	} else {
+		res = &SearchResults{}
+		if res.Files, err = fs.search(ctx, p, len(dir), q, mode == "fuzzy"); err != nil {
+			return nil, err
+		}
+		res.Total = int64(len(res.Files))
+	}
+	if err := fs.snippets(ctx, dir, q, res.Files); err != nil {
+		return nil, err
+	}
+
+	if fs.CacheSize > 0 {
+		fs.results.put(key, gen, res, fs.CacheSize)
+	}
+	return res, nil
+}
+
+// list returns the entries in the directories matching glob p
+func (fs *CachedFS) list(ctx context.Context, p string, trim int) (Files, error) {
+	rows, err := fs.qs.QueryContext(ctx, p, "%")
+	if err != nil {
+		return nil, err
+	}
+	return readFiles(rows, trim)
+}
+
+// readFiles reads the (root, name, dir) rows of a listing, trimming the first trim bytes of the root
+func readFiles(rows *sql.Rows, trim int) (Files, error) {
 	defer rows.Close()
 
+	resp := make(Files, 0)
 	for rows.Next() {
 		var root string
 		var name string
 		var dir bool
 		if err := rows.Scan(&root, &name, &dir); err != nil {
-			logError(http.StatusInternalServerError, err, w, r)
-			return
+			return nil, err
+		}
+		if len(root) < trim {
+			continue
 		}
 
 		f := File{Name: root[trim:] + name}
@@ -368,67 +734,68 @@ func (fs *CachedFS) serveCache(w http.ResponseWriter, r *http.Request) {
 		resp = append(resp, f)
 	}
 
-	if err := rows.Err(); err != nil {
-		logError(http.StatusInternalServerError, err, w, r)
-		return
-	}
-
-	sort.Sort(resp)
-
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Cache-Control", "max-age=60")
-	json.NewEncoder(w).Encode(resp)
+	return resp, rows.Err()
 }
 
 func (fs *CachedFS) serveLive(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	p := filepath.Join(fs.Root, filepath.FromSlash(r.URL.Path), "_")
 	p = p[:len(p)-1]
 
-	resp := make(Files, 0)
-	search, err := regexp.Compile(escapeRegex(r.URL.Query().Get("q")))
+	search, err := parseSearch(r.URL.Query().Get("q"), r.URL.Query().Get("mode"))
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
 
-	if err == nil {
-		trim := len(p)
-		depth := 0
-		err = walk.Walk(p, &walk.Options{
-			Error: func(r string, e *walk.Dirent, err error) error {
-				logErr.Printf("Error iterating \"%s\": %s\n", r, err.Error())
+	// File contents are only searchable in the index
+	if hasContent(search) {
+		fs.serveCache(w, r)
+		return
+	}
+
+	resp := make(Files, 0)
+	dir := cleanPath(r.URL.Path)
+	trim := len(p)
+	depth := 0
+	err = walk.Walk(p, &walk.Options{
+		Error: func(r string, e *walk.Dirent, err error) error {
+			logErr.Printf("Error iterating \"%s\": %s\n", r, err.Error())
+			return nil
+		},
+		Visit: func(r string, e *walk.Dirent) error {
+			if depth == 0 {
 				return nil
-			},
-			Visit: func(r string, e *walk.Dirent) error {
-				if depth == 0 {
-					return nil
-				}
+			}
 
-				n := e.Name()
-				if n == "" || strings.HasPrefix(n, ".") || !search.MatchString(n) {
-					return nil
-				}
+			n := e.Name()
+			if n == "" || strings.HasPrefix(n, ".") || !matchQuery(search, dir, n, e.IsDir(), r) {
+				return nil
+			}
 
-				f := File{Name: filepath.ToSlash(r[trim:])}
-				if e.IsDir() {
-					f.Type = "d"
-				} else {
-					f.Type = "f"
-				}
+			f := File{Name: filepath.ToSlash(r[trim:])}
+			if e.IsDir() {
+				f.Type = "d"
+			} else {
+				f.Type = "f"
+			}
 
-				resp = append(resp, f)
+			resp = append(resp, f)
 
-				return nil
-			},
-			Enter: func(r string, e *walk.Dirent) error {
-				if depth >= 1 {
-					return filepath.SkipDir
-				}
-				depth++
-				return nil
-			},
-			Leave: func(r string, e *walk.Dirent, err error) error {
-				depth--
-				return err
-			},
-		})
-	}
+			return nil
+		},
+		Enter: func(r string, e *walk.Dirent) error {
+			if depth >= 1 {
+				return filepath.SkipDir
+			}
+			depth++
+			return nil
+		},
+		Leave: func(r string, e *walk.Dirent, err error) error {
+			depth--
+			return err
+		},
+	})
 
 	if err == walk.ErrNonDir || os.IsNotExist(err) || os.IsPermission(err) {
 		http.NotFound(w, r)
@@ -438,18 +805,36 @@ func (fs *CachedFS) serveLive(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	if err := fs.attachAggregates(ctx, dir, resp); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
 	sort.Sort(resp)
 
+	if search != nil {
+		fs.searched(r, start, dir, int64(len(resp)))
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Cache-Control", "max-age=60")
 	json.NewEncoder(w).Encode(resp)
 }
 
 func (fs *CachedFS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if fs.Cached || r.URL.Query().Get("r") != "" {
+	if _, ok := r.URL.Query()["changes"]; ok {
+		fs.serveChanges(w, r)
+	} else if _, ok := r.URL.Query()["du"]; ok {
+		fs.serveUsage(w, r)
+	} else if r.URL.Query().Get("at") != "" {
+		fs.serveHistory(w, r)
+	} else if fs.Cached || r.URL.Query().Get("r") != "" || r.URL.Query().Get("mode") == "fuzzy" {
 		fs.serveCache(w, r)
 	} else {
-		fs.serveLive(w, r)
+		fs.Guard(http.HandlerFunc(fs.serveLive)).ServeHTTP(w, r)
 	}
 }
 
@@ -0,0 +1,61 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestFS creates a temporary directory with the given files and an empty
+// index of it, in a database private to the test. Options can be set before
+// the first fill.
+func newTestFS(t *testing.T, names ...string) (*CachedFS, string) {
+	t.Helper()
+	root := t.TempDir()
+	writeFiles(t, root, names...)
+
+	fs, err := New("file:"+url.PathEscape(t.Name())+"?mode=memory&cache=shared", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fs.Close() })
+	fs.Timeout = time.Minute
+
+	return fs, root
+}
+
+// writeFiles creates empty files and their parent directories below root.
+// Names ending in a slash are created as directories.
+func writeFiles(t *testing.T, root string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fill refreshes the entire index
+func fill(t *testing.T, fs *CachedFS) {
+	t.Helper()
+	if _, err := fs.Fill(); err != nil {
+		t.Fatal(err)
+	}
+}
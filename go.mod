@@ -5,6 +5,7 @@ go 1.17
 require (
 	github.com/mattn/go-sqlite3 v1.14.13
 	github.com/ulule/limiter/v3 v3.10.0
+	golang.org/x/text v0.13.0
 )
 
 require github.com/pkg/errors v0.9.1 // indirect
@@ -0,0 +1,99 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors
+var (
+	ErrUnavailable = errors.New("backing store unavailable")
+)
+
+// Seconds clients are asked to wait before retrying while the backing store is unavailable
+const retryAfter = 60
+
+// Interval between availability checks of the backing store
+const availInterval = 5 * time.Second
+
+type availability struct {
+	mut  sync.Mutex
+	last time.Time
+	err  error
+}
+
+// Available checks whether the backing store is present, i.e. whether the root
+// is a directory, the sentinel file exists and the root is a mountpoint (if requested).
+func (fs *CachedFS) Available() error {
+	s, err := os.Stat(fs.Root)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+	}
+	if !s.IsDir() {
+		return fmt.Errorf("%w: root is not a directory", ErrUnavailable)
+	}
+
+	if fs.Sentinel != "" {
+		if _, err := os.Stat(filepath.Join(fs.Root, fs.Sentinel)); err != nil {
+			return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+		}
+	}
+
+	if fs.Mountpoint {
+		m, err := isMountpoint(fs.Root)
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUnavailable, err.Error())
+		}
+		if !m {
+			return fmt.Errorf("%w: root is not a mountpoint", ErrUnavailable)
+		}
+	}
+
+	return nil
+}
+
+// available returns the (recently) cached result of Available
+func (fs *CachedFS) available() error {
+	fs.avail.mut.Lock()
+	defer fs.avail.mut.Unlock()
+
+	if time.Since(fs.avail.last) < availInterval {
+		return fs.avail.err
+	}
+
+	err := fs.Available()
+	if (err == nil) != (fs.avail.err == nil) {
+		if err != nil {
+			logErr.Printf("Backing store went offline: %s\n", err.Error())
+		} else {
+			logErr.Println("Backing store is back online")
+		}
+	}
+
+	fs.avail.err = err
+	fs.avail.last = time.Now()
+	return err
+}
+
+// Guard responds with 503 Service Unavailable while the backing store is unavailable
+func (fs *CachedFS) Guard(han http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fs.available() != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		han.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,87 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	fs, root := newTestFS(t, ".online", "a.txt", "b.txt", "c.txt", "d.txt")
+	fs.Sentinel = ".online"
+	fs.MaxShrink = 0.5
+	fill(t, fs)
+	gen := fs.Generation()
+
+	han := fs.Guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	get := func(status int) *httptest.ResponseRecorder {
+		t.Helper()
+		// Skip the cached result of the last check
+		fs.avail.last = time.Time{}
+
+		w := httptest.NewRecorder()
+		han.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != status {
+			t.Fatalf("Expected status %d, got %d\n", status, w.Code)
+		}
+		return w
+	}
+
+	get(http.StatusOK)
+
+	// Backing store disappears
+	if err := os.Remove(filepath.Join(root, ".online")); err != nil {
+		t.Fatal(err)
+	}
+	if w := get(http.StatusServiceUnavailable); w.Header().Get("Retry-After") != strconv.Itoa(retryAfter) {
+		t.Fatalf("Expected Retry-After, got %v\n", w.Header())
+	}
+	if _, err := fs.Fill(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("Expected ErrUnavailable, got %v\n", err)
+	}
+
+	// Back online, but most files are missing
+	writeFiles(t, root, ".online")
+	get(http.StatusOK)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.Remove(filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Fill(); err == nil {
+		t.Fatal("Expected shrinking refresh to be refused")
+	}
+
+	var n int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM files").Scan(&n); err != nil || n != 4 {
+		t.Fatalf("Expected index to be kept, got %d entries (%v)\n", n, err)
+	}
+	if fs.Generation() != gen {
+		t.Fatalf("Expected generation %d, got %d\n", gen, fs.Generation())
+	}
+
+	// Deliberate removal, acknowledged once
+	fs.AllowShrink()
+	if _, err := fs.Fill(); err != nil {
+		t.Fatalf("Expected acknowledged shrink, got %v\n", err)
+	}
+	writeFiles(t, root, "a.txt", "b.txt", "c.txt")
+	fill(t, fs)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.Remove(filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.Fill(); err == nil {
+		t.Fatal("Expected acknowledgement to be used up")
+	}
+}
@@ -0,0 +1,240 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Errors
+var (
+	ErrNoHistory = errors.New("index history not available")
+)
+
+// generationAt returns the generation that was current at time t
+func (fs *CachedFS) generationAt(ctx context.Context, t int64) (int64, error) {
+	var gen int64
+	if err := fs.db.QueryRowContext(ctx, "SELECT gen FROM generations WHERE time <= ? ORDER BY gen DESC LIMIT 1", t).Scan(&gen); err == sql.ErrNoRows {
+		return 0, ErrNoHistory
+	} else if err != nil {
+		return 0, err
+	}
+
+	// History can only be reconstructed if every later generation was tracked
+	var untracked int
+	if err := fs.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM generations WHERE gen > ? AND added IS NULL", gen).Scan(&untracked); err != nil {
+		return 0, err
+	}
+	if untracked > 0 {
+		return 0, ErrNoHistory
+	}
+
+	return gen, nil
+}
+
+// serveHistory serves a directory listing or recursive search as it was at a point in time,
+// by rolling back the logged changes on top of the current index
+func (fs *CachedFS) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if !fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	at, err := parseTime(r.URL.Query().Get("at"))
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	query, err := parseSearch(r.URL.Query().Get("q"), mode)
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	gen, err := fs.generationAt(ctx, at)
+	if err == ErrNoHistory {
+		http.Error(w, "410 Gone", http.StatusGone)
+		return
+	} else if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	dir := cleanPath(r.URL.Path)
+	trim := len(dir)
+
+	p := escapeGlob(dir)
+	if r.URL.Query().Get("r") != "" {
+		p += "*"
+	}
+
+	// Search like the current index, matching the logged entries by their state at gen
+	var terms []term
+	if query != nil {
+		if mode == "fuzzy" {
+			if err := fs.resolve(ctx, query); err != nil {
+				logError(http.StatusInternalServerError, err, w, r)
+				return
+			}
+		}
+		terms = rankTerms(query)
+	}
+
+	// Earliest change of every entry since gen describes its state at gen, the latest whether it still exists
+	rows, err := fs.db.QueryContext(ctx, `SELECT root, name, dir, op, osize, omtime, MIN(rowid),
+		(SELECT l.op FROM changes l WHERE l.root = changes.root AND l.name = changes.name ORDER BY l.rowid DESC LIMIT 1)
+		FROM changes WHERE gen > ? AND root GLOB ? GROUP BY root, name`, gen, p)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	resp := make(Files, 0)
+	file := func(root string, name string, dir bool, gone bool) File {
+		f := File{Name: root[trim:] + name, Gone: gone}
+		if dir {
+			f.Type = "d"
+		} else {
+			f.Type = "f"
+		}
+		return f
+	}
+
+	for rows.Next() {
+		var e queryEntry
+		var op, last string
+		var size, mtime sql.NullInt64
+		var id int64
+		if err := rows.Scan(&e.root, &e.name, &e.dir, &op, &size, &mtime, &id, &last); err != nil {
+			rows.Close()
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+
+		// Did not exist yet at gen
+		if op == "added" {
+			continue
+		}
+
+		e.size, e.mtime, e.stat = size.Int64, mtime.Int64, true
+		if query == nil || query.match(&e) {
+			resp = append(resp, file(e.root, e.name, e.dir, last == "removed"))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	// Entries that did not change since gen are as they are now
+	current := func(substr bool) error {
+		where, args := "1", []interface{}(nil)
+		limit := 1000
+		if query != nil {
+			where, args = compileQuery(query, substr)
+			limit = searchCandidates
+		}
+
+		rows, err := fs.db.QueryContext(ctx, `SELECT dirs.path, files.name, files.dir FROM files JOIN dirs ON files.root = dirs.rowid
+			WHERE files.root IN (SELECT rowid FROM dirs WHERE path GLOB ?) AND `+where+`
+			AND NOT EXISTS (SELECT 1 FROM changes WHERE changes.gen > ? AND changes.root = dirs.path AND changes.name = files.name) LIMIT ?`,
+			append(append([]interface{}{p}, args...), gen, limit)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var root, name string
+			var dir bool
+			if err := rows.Scan(&root, &name, &dir); err != nil {
+				return err
+			}
+			resp = append(resp, file(root, name, dir, false))
+		}
+		return rows.Err()
+	}
+
+	if err := current(false); err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	// No token matches, fall back to substrings
+	if len(resp) == 0 && len(terms) > 0 && mode != "fuzzy" {
+		if err := current(true); err != nil {
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+	}
+
+	if len(resp) == 0 {
+		var n int
+		if err := fs.db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM dirs WHERE path = ?) + (SELECT COUNT(*) FROM changes WHERE root GLOB ?)", dir, escapeGlob(dir)+"*").Scan(&n); err != nil {
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+		if n == 0 {
+			http.NotFound(w, r)
+			return
+		}
+	}
+
+	if query != nil {
+		resp = rankFiles(resp, terms)
+	} else {
+		sort.Sort(resp)
+		if len(resp) > 1000 {
+			resp = resp[:1000]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Gone responds with 410 Gone for files that no longer exist, but used to be in the index
+func (fs *CachedFS) Gone(han http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !fs.DBReady() || r.URL.Path == "" {
+			han.ServeHTTP(w, r)
+			return
+		}
+
+		p := path.Clean("/" + r.URL.Path)
+		if _, err := os.Stat(filepath.Join(fs.Root, filepath.FromSlash(p))); !os.IsNotExist(err) {
+			han.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+		defer cancel()
+
+		root, name := path.Split(p)
+
+		var op string
+		if err := fs.db.QueryRowContext(ctx, "SELECT op FROM changes WHERE root = ? AND name = ? ORDER BY rowid DESC LIMIT 1", root, name).Scan(&op); err == nil && op == "removed" {
+			http.Error(w, "410 Gone", http.StatusGone)
+			return
+		}
+
+		han.ServeHTTP(w, r)
+	})
+}
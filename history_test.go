@@ -0,0 +1,107 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	fs, root := newTestFS(t, "Café Notes.txt", "keep.iso", "dir/a.txt")
+	fs.Retention = time.Hour
+	fill(t, fs)
+	old := fs.Generation()
+	if _, err := fs.db.Exec("UPDATE generations SET time = time - 100 WHERE gen = ?", old); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove(filepath.Join(root, "Café Notes.txt"))
+	os.WriteFile(filepath.Join(root, "keep.iso"), []byte("modified"), 0644)
+	os.WriteFile(filepath.Join(root, "new café.txt"), nil, 0644)
+	fill(t, fs)
+
+	at := time.Now().Unix() - 50
+	if gen, err := fs.generationAt(context.Background(), at); err != nil || gen != old {
+		t.Fatalf("Expected generation %d, got %d (%v)\n", old, gen, err)
+	}
+	if _, err := fs.generationAt(context.Background(), at-1000); err != ErrNoHistory {
+		t.Fatalf("Expected ErrNoHistory, got %v\n", err)
+	}
+
+	get := func(u string, status int) Files {
+		t.Helper()
+		w := httptest.NewRecorder()
+		fs.serveHistory(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != status {
+			t.Fatalf("%s: Expected status %d, got %d\n", u, status, w.Code)
+		}
+		var f Files
+		if status == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return f
+	}
+
+	ts := strconv.FormatInt(at, 10)
+	for _, c := range []struct {
+		q    string
+		want []File
+	}{
+		{"", []File{{Name: "dir", Type: "d"}, {Name: "Café Notes.txt", Type: "f", Gone: true}, {Name: "keep.iso", Type: "f"}}},
+		{"&q=" + url.QueryEscape("CAFE notes"), []File{{Name: "Café Notes.txt", Type: "f", Gone: true}}},
+		{"&q=" + url.QueryEscape("cafe OR keep"), []File{{Name: "keep.iso", Type: "f"}, {Name: "Café Notes.txt", Type: "f", Gone: true}}},
+		{"&q=" + url.QueryEscape("cafe -notes"), nil},
+		{"&r=1&q=a.txt", []File{{Name: "dir/a.txt", Type: "f"}}},
+	} {
+		res := get("/?at="+ts+c.q, http.StatusOK)
+		if len(res) != len(c.want) {
+			t.Errorf("%s: Unexpected results %+v\n", c.q, res)
+			continue
+		}
+		for i := range res {
+			if res[i].Name != c.want[i].Name || res[i].Type != c.want[i].Type || res[i].Gone != c.want[i].Gone {
+				t.Errorf("%s: Expected %+v, got %+v\n", c.q, c.want[i], res[i])
+			}
+		}
+	}
+
+	// Ranked like the current index
+	if res := get("/?at="+ts+"&q=cafe", http.StatusOK); len(res) != 1 || res[0].Score == 0 || len(res[0].Matches) == 0 {
+		t.Errorf("Expected ranked results, got %+v\n", res)
+	}
+
+	get("/?at="+strconv.FormatInt(at-1000, 10), http.StatusGone)
+	get("/?at=invalid", http.StatusBadRequest)
+	get("/?at="+ts+"&q=a&mode=invalid", http.StatusBadRequest)
+
+	dl := fs.Gone(http.FileServer(http.Dir(root)))
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/Café Notes.txt", http.StatusGone},
+		{"/keep.iso", http.StatusOK},
+		{"/never.txt", http.StatusNotFound},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = c.path
+		w := httptest.NewRecorder()
+		dl.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s: Expected status %d, got %d\n", c.path, c.status, w.Code)
+		}
+	}
+}
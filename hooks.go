@@ -0,0 +1,378 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum number of output bytes of a hook command that is logged
+const hookOutput = 512
+
+// Number of queued changes fetched at once by the dispatcher
+const hookBatch = 64
+
+// Hooks runs a command for every file that is added or modified in a published generation.
+// Pending runs are kept in the database, so they survive restarts.
+type Hooks struct {
+	fs      *CachedFS
+	command []string
+	wake    chan struct{}
+
+	// Changes that ran, but are still queued because their outcome could not be stored
+	mut    sync.Mutex
+	failed []Change
+
+	Jobs    int
+	Timeout time.Duration
+}
+
+// HookRun is the outcome of a hook command
+type HookRun struct {
+	ID       int64  `json:"id"`
+	Time     int64  `json:"time"`
+	Gen      int64  `json:"gen"`
+	Name     string `json:"name"`
+	Op       string `json:"op"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"duration"`
+	Output   string `json:"output,omitempty"`
+}
+
+// NewHooks running command (split on whitespace) for the changes published by fs
+func NewHooks(fs *CachedFS, command string) (*Hooks, error) {
+	if _, err := fs.db.Exec(`
+		CREATE TABLE IF NOT EXISTS hook_queue (gen INTEGER, time INTEGER, name TEXT, op TEXT, size INTEGER, mtime INTEGER);
+		CREATE TABLE IF NOT EXISTS hook_runs (time INTEGER, gen INTEGER, name TEXT, op TEXT, status INTEGER, error TEXT, duration INTEGER, output TEXT);
+		CREATE INDEX IF NOT EXISTS idx_hook_runs_time ON hook_runs (time);
+	`); err != nil {
+		return nil, err
+	}
+
+	h := Hooks{
+		fs:      fs,
+		command: strings.Fields(command),
+		wake:    make(chan struct{}, 1),
+		Jobs:    4,
+		Timeout: time.Minute,
+	}
+
+	fs.OnChange(func(gen int64) {
+		if err := h.enqueue(gen); err != nil {
+			logErr.Printf("Exec: %s\n", err.Error())
+		}
+	})
+
+	return &h, nil
+}
+
+func (h *Hooks) signal() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue the added and modified files of generation gen
+func (h *Hooks) enqueue(gen int64) error {
+	res, err := h.fs.db.Exec(`INSERT INTO hook_queue (gen, time, name, op, size, mtime)
+		SELECT gen, time, root || name, op, size, mtime FROM changes WHERE gen = ? AND NOT dir AND op != 'removed' ORDER BY rowid`, gen)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n > 0 {
+		h.signal()
+	}
+	return nil
+}
+
+// pending returns up to hookBatch queued changes after rowid last
+func (h *Hooks) pending(ctx context.Context, last int64) ([]Change, error) {
+	rows, err := h.fs.db.QueryContext(ctx, "SELECT rowid, gen, time, name, op, size, mtime FROM hook_queue WHERE rowid > ? ORDER BY rowid LIMIT ?", last, hookBatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Change
+	for rows.Next() {
+		c := Change{Type: "f"}
+		var size, mtime sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.Gen, &c.Time, &c.Name, &c.Op, &size, &mtime); err != nil {
+			return nil, err
+		}
+		if size.Valid {
+			c.Size = &size.Int64
+		}
+		if mtime.Valid {
+			c.Mtime = &mtime.Int64
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// limitedBuffer keeps the first n bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+	n int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if r := b.n - b.Len(); r > 0 {
+		if len(p) > r {
+			b.Buffer.Write(p[:r])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// run the command for change c, passing it in environment variables and as JSON on stdin
+func (h *Hooks) run(ctx context.Context, c *Change) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+
+	in, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	var size, mtime int64
+	if c.Size != nil {
+		size = *c.Size
+	}
+	if c.Mtime != nil {
+		mtime = *c.Mtime
+	}
+
+	out := limitedBuffer{n: hookOutput}
+	cmd := exec.Command(h.command[0], h.command[1:]...)
+	cmd.Dir = h.fs.Root
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.Env = append(os.Environ(),
+		"AUTOINDEX_PATH="+c.Name,
+		"AUTOINDEX_FILE="+filepath.Join(h.fs.Root, filepath.FromSlash(c.Name)),
+		"AUTOINDEX_OP="+c.Op,
+		"AUTOINDEX_SIZE="+strconv.FormatInt(size, 10),
+		"AUTOINDEX_MTIME="+strconv.FormatInt(mtime, 10),
+		"AUTOINDEX_GEN="+strconv.FormatInt(c.Gen, 10),
+	)
+
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	close(done)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out")
+	}
+	return strings.TrimSpace(out.String()), err
+}
+
+// done logs the outcome of the command for change c, and removes it from the queue
+func (h *Hooks) done(c *Change, dur time.Duration, out string, err error) error {
+	run := HookRun{Time: time.Now().Unix(), Gen: c.Gen, Name: c.Name, Op: c.Op, Duration: dur.Milliseconds(), Output: out}
+
+	dur = dur.Round(time.Millisecond)
+	switch e := err.(type) {
+	case nil:
+		logErr.Printf("Exec: %s (%s) exited with status 0 in %s\n", c.Name, c.Op, dur)
+	case *exec.ExitError:
+		run.Status = e.ExitCode()
+		logErr.Printf("Exec: %s (%s) exited with status %d in %s: %q\n", c.Name, c.Op, run.Status, dur, out)
+	default:
+		run.Status = -1
+		run.Error = err.Error()
+		logErr.Printf("Exec: %s (%s) failed after %s: %s %q\n", c.Name, c.Op, dur, err.Error(), out)
+	}
+
+	tx, err := h.fs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM hook_queue WHERE rowid = ?", c.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO hook_runs (time, gen, name, op, status, error, duration, output) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		run.Time, run.Gen, run.Name, run.Op, run.Status, run.Error, run.Duration, run.Output); err != nil {
+		return err
+	}
+	if h.fs.Retention > 0 {
+		if _, err := tx.Exec("DELETE FROM hook_runs WHERE time < ?", time.Now().Add(-h.fs.Retention).Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *Hooks) work(ctx context.Context, jobs <-chan Change) {
+	for c := range jobs {
+		start := time.Now()
+		out, err := h.run(ctx, &c)
+		if ctx.Err() != nil {
+			// Run again after a restart
+			continue
+		}
+		if err := h.done(&c, time.Since(start), out, err); err != nil {
+			logErr.Printf("Exec: %s\n", err.Error())
+
+			// Behind the cursor of the dispatcher, hand it out again on its next pass
+			h.mut.Lock()
+			h.failed = append(h.failed, c)
+			h.mut.Unlock()
+		}
+	}
+}
+
+// Run the hook command with up to Jobs concurrent processes, until ctx is done
+func (h *Hooks) Run(ctx context.Context) {
+	if len(h.command) == 0 || h.Jobs < 1 {
+		return
+	}
+
+	jobs := make(chan Change)
+	var wg sync.WaitGroup
+	for i := 0; i < h.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.work(ctx, jobs)
+		}()
+	}
+	defer wg.Wait()
+	defer close(jobs)
+
+	// Changes are handed out in order, those still queued at startup are run (again) first
+	var last int64
+	for {
+		h.mut.Lock()
+		retry := h.failed
+		h.failed = nil
+		h.mut.Unlock()
+
+		batch, err := h.pending(ctx, last)
+		if err != nil && ctx.Err() == nil {
+			logErr.Printf("Exec: %s\n", err.Error())
+		}
+
+		for _, c := range append(retry, batch...) {
+			select {
+			case jobs <- c:
+				if c.ID > last {
+					last = c.ID
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(batch) == hookBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.wake:
+		case <-time.After(time.Minute):
+		}
+	}
+}
+
+// Runs returns up to limit outcomes of hook commands, newest first, older than run before (if > 0)
+func (h *Hooks) Runs(ctx context.Context, before int64, limit int) ([]HookRun, error) {
+	if before <= 0 {
+		before = math.MaxInt64
+	}
+	rows, err := h.fs.db.QueryContext(ctx, "SELECT rowid, time, gen, name, op, status, error, duration, output FROM hook_runs WHERE rowid < ? ORDER BY rowid DESC LIMIT ?", before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]HookRun, 0)
+	for rows.Next() {
+		var r HookRun
+		if err := rows.Scan(&r.ID, &r.Time, &r.Gen, &r.Name, &r.Op, &r.Status, &r.Error, &r.Duration, &r.Output); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// ServeHTTP serves the outcomes of hook commands (before=<id>, limit=<n>), newest first
+func (h *Hooks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var before int64
+	if s := q.Get("before"); s != "" {
+		var err error
+		if before, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 100
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if limit > 1000 {
+			limit = 1000
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.fs.Timeout)
+	defer cancel()
+
+	res, err := h.Runs(ctx, before, limit)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(res)
+}
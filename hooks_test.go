@@ -0,0 +1,223 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const hookScript = `#!/bin/sh
+case "$AUTOINDEX_PATH" in
+	*slow*) exec sleep 30 ;;
+	*fail*) echo "failed" >&2; exit 3 ;;
+esac
+touch "$RUN/$$"
+ls "$RUN" | wc -l >> "$MAX"
+sleep 0.2
+{ echo "$AUTOINDEX_PATH $AUTOINDEX_OP $AUTOINDEX_SIZE $AUTOINDEX_GEN $AUTOINDEX_FILE"; cat; } > "$OUT/$(basename "$AUTOINDEX_PATH")"
+rm "$RUN/$$"
+`
+
+func TestHooks(t *testing.T) {
+	fs, root := newTestFS(t)
+	fs.Retention = time.Hour
+
+	work := t.TempDir()
+	writeFiles(t, work, "run/", "out/")
+	script := filepath.Join(work, "hook.sh")
+	if err := os.WriteFile(script, []byte(hookScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RUN", filepath.Join(work, "run"))
+	t.Setenv("OUT", filepath.Join(work, "out"))
+	t.Setenv("MAX", filepath.Join(work, "max"))
+
+	h, err := NewHooks(fs, script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Jobs = 2
+	h.Timeout = 500 * time.Millisecond
+
+	fill(t, fs)
+
+	names := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt", "fail.txt", "slow.txt"}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(root, n), []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFiles(t, root, "dir/")
+	fill(t, fs)
+	gen := fs.Generation()
+
+	// Queued in the database before anything runs
+	var queued int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM hook_queue").Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != len(names) {
+		t.Fatalf("Expected %d queued changes, got %d\n", len(names), queued)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+
+	var runs []HookRun
+	for deadline := time.Now().Add(10 * time.Second); len(runs) < len(names); time.Sleep(50 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d runs, got %+v\n", len(names), runs)
+		}
+		if runs, err = h.Runs(context.Background(), 0, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cancel()
+	<-done
+
+	for _, r := range runs {
+		switch r.Name {
+		case "/fail.txt":
+			if r.Status != 3 || r.Output != "failed" {
+				t.Errorf("Unexpected run %+v\n", r)
+			}
+		case "/slow.txt":
+			if r.Status != -1 || r.Error != "timed out" || r.Duration > 5000 {
+				t.Errorf("Expected command to be killed, got %+v\n", r)
+			}
+		default:
+			if r.Status != 0 || r.Gen != gen || r.Op != "added" {
+				t.Errorf("Unexpected run %+v\n", r)
+			}
+		}
+	}
+
+	// Environment and stdin
+	b, err := os.ReadFile(filepath.Join(work, "out", "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.SplitN(string(b), "\n", 2)
+	if want := "/a.txt added 3 " + strconv.FormatInt(gen, 10) + " " + filepath.Join(root, "a.txt"); lines[0] != want {
+		t.Errorf("Expected environment %q, got %q\n", want, lines[0])
+	}
+	var c Change
+	if err := json.Unmarshal([]byte(lines[1]), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Name != "/a.txt" || c.Op != "added" || c.Gen != gen || c.Size == nil || *c.Size != 3 {
+		t.Errorf("Unexpected stdin %+v\n", c)
+	}
+
+	// Concurrency limit
+	f, err := os.Open(filepath.Join(work, "max"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	max := 0
+	for s := bufio.NewScanner(f); s.Scan(); {
+		if n, _ := strconv.Atoi(strings.TrimSpace(s.Text())); n > max {
+			max = n
+		}
+	}
+	if max < 1 || max > h.Jobs {
+		t.Errorf("Expected at most %d concurrent commands, got %d\n", h.Jobs, max)
+	}
+
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM hook_queue").Scan(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued != 0 {
+		t.Errorf("Expected empty queue, got %d\n", queued)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/?limit=2", nil))
+	var page []HookRun
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil || len(page) != 2 || page[0].ID <= page[1].ID {
+		t.Errorf("Unexpected page %+v (%v)\n", page, err)
+	}
+}
+
+func TestHooksRetry(t *testing.T) {
+	fs, root := newTestFS(t)
+	fs.Retention = time.Hour
+
+	h, err := NewHooks(fs, "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Jobs = 1
+
+	fill(t, fs)
+	writeFiles(t, root, "a.txt")
+	fill(t, fs)
+
+	// Outcome of the first run cannot be stored
+	if _, err := fs.db.Exec("ALTER TABLE hook_runs RENAME TO hook_runs_off"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		h.mut.Lock()
+		n := len(h.failed)
+		h.mut.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected failure to store the outcome")
+		}
+	}
+	if _, err := fs.db.Exec("ALTER TABLE hook_runs_off RENAME TO hook_runs"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run again on the next pass
+	h.signal()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var queued int
+		if err := fs.db.QueryRow("SELECT COUNT(*) FROM hook_queue").Scan(&queued); err != nil {
+			t.Fatal(err)
+		}
+		if queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected queued change to be retried")
+		}
+	}
+	if runs, err := h.Runs(context.Background(), 0, 100); err != nil || len(runs) != 1 || runs[0].Name != "/a.txt" {
+		t.Errorf("Unexpected runs %+v (%v)\n", runs, err)
+	}
+}
@@ -5,8 +5,15 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -18,6 +25,7 @@ import (
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/nielsAD/autoindex/sched"
 	"github.com/ulule/limiter/v3"
 	"github.com/ulule/limiter/v3/drivers/middleware/stdlib"
 	"github.com/ulule/limiter/v3/drivers/store/memory"
@@ -27,26 +35,81 @@ var (
 	addr      = flag.String("a", ":80", "TCP network address to listen for connections")
 	db        = flag.String("d", "file::memory:?cache=shared", "Database location")
 	dir       = flag.String("r", ".", "Root directory to serve")
-	refresh   = flag.String("i", "1h", "Refresh interval")
+	refresh   = flag.String("i", "1h", "Refresh interval or schedule (e.g. 30m, @daily or \"0 4 * * *\", 0 to disable)")
 	ratelimit = flag.Int64("l", 5, "Request rate limit (req/sec per IP)")
 	timeout   = flag.Duration("t", time.Second, "Request timeout")
 	forwarded = flag.Bool("forwarded", false, "Trust X-Real-IP and X-Forwarded-For headers")
 	cached    = flag.Bool("cached", false, "Serve everything from cache (rather than search/recursive queries only)")
+	retention = flag.Duration("changes", 30*24*time.Hour, "Keep log of changes between refreshes for this long (0 to disable)")
+	stale     = flag.Duration("stale", 0, "Re-read cached directories older than this when visited (0 to disable)")
+	async     = flag.Bool("stale-async", false, "Re-read stale directories in the background (rather than within request timeout)")
+	sentinel  = flag.String("sentinel", "", "Only update index if this file exists in root directory")
+	mount     = flag.Bool("mountpoint", false, "Only update index if root directory is a mountpoint")
+	shrink    = flag.Float64("shrink", 0, "Refuse index updates that remove more than this fraction of entries (0 to disable)")
+	jitter    = flag.Duration("jitter", 0, "Random delay added to every scheduled refresh")
+	backoff   = flag.Duration("backoff", time.Minute, "Delay before retrying a failed refresh, doubled after every consecutive failure (0 to disable)")
+	backMax   = flag.Duration("backoff-max", time.Hour, "Maximum delay before retrying a failed refresh")
+	events    = flag.Int("events", 256, "Maximum number of concurrent live update streams (0 to disable)")
+	format    = flag.String("format", "", "Export/import format (ndjson or csv, default by file extension)")
+	dupes     = flag.Bool("duplicates", false, "Find duplicate files after every refresh")
+	command   = flag.String("exec", "", "Run command for every added or modified file (path in $AUTOINDEX_PATH, details as JSON on stdin)")
+	execJobs  = flag.Int("exec-jobs", 4, "Maximum number of concurrently running -exec commands")
+	execTime  = flag.Duration("exec-timeout", time.Minute, "Kill -exec commands that run longer than this")
+	content   = flag.String("content", "", "Index the text of files with these extensions (comma separated, e.g. txt,md,html,docx,odt)")
+	contentSz = flag.Int64("content-size", 10<<20, "Maximum size (in bytes) of files indexed by -content (0 for no limit)")
+	analytics = flag.Duration("analytics", 0, "Record searches and the downloads that follow them for this long (0 to disable)")
+	anonymize = flag.Bool("analytics-anonymize", false, "Only record the network (/24 or /48) of client addresses in -analytics")
+	admin     = flag.String("admin", "", "Password for the reports and statistics on /admin/ (user name is ignored, empty to disable)")
+	cacheSize = flag.Int64("cache", 32<<20, "Memory (in bytes) for caching search results of the current index generation (0 to disable)")
 )
 
 var logOut = log.New(os.Stdout, "", 0)
 var logErr = log.New(os.Stderr, "", 0)
 
 func main() {
-	flag.Parse()
+	var subtrees policies
+	var hooks webhooks
+	var manifests prefixes
+	flag.Var(&subtrees, "subtree", "Refresh interval or schedule for a subtree (path=schedule, repeatable)")
+	flag.Var(&hooks, "webhook", "Notify URL of changes (url[,prefix=path][,secret=key], repeatable)")
+	flag.Var(&manifests, "manifest", "Generate ls-lR.gz, mtree and find.txt for a subtree after every refresh (repeatable)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %[1]s [options]\n       %[1]s export|import [options] [file]\n       %[1]s duplicates [options] [path]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
-	var interval time.Duration
-	if *refresh != "" {
-		i, err := time.ParseDuration(*refresh)
-		if err != nil {
-			logErr.Fatal(err)
+	cmd := ""
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "export" || args[0] == "import" || args[0] == "duplicates") {
+		cmd = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+
+	if *execJobs < 1 {
+		logErr.Fatal("-exec-jobs must be at least 1")
+	}
+
+	// Notifications are derived from the change log
+	if *retention <= 0 && len(hooks) > 0 {
+		logErr.Fatal("-webhook requires the change log (-changes)")
+	}
+	if *retention <= 0 && *command != "" {
+		logErr.Fatal("-exec requires the change log (-changes)")
+	}
+	if *retention <= 0 && *events > 0 {
+		explicit := false
+		flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "events" })
+		if explicit {
+			logErr.Fatal("-events requires the change log (-changes)")
 		}
-		interval = i
+		logErr.Println("Live updates disabled, they require the change log (-changes)")
+		*events = 0
+	}
+
+	schedule, err := sched.Parse(*refresh)
+	if err != nil {
+		logErr.Fatal(err)
 	}
 
 	fs, err := New(*db, *dir)
@@ -56,23 +119,145 @@ func main() {
 
 	fs.Timeout = *timeout
 	fs.Cached = *cached
+	fs.Retention = *retention
+	fs.Stale = *stale
+	fs.StaleAsync = *async
+	fs.Sentinel = *sentinel
+	fs.Mountpoint = *mount
+	fs.MaxShrink = *shrink
+	fs.ContentSize = *contentSz
+	fs.CacheSize = *cacheSize
+	for _, e := range strings.Split(*content, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			fs.Content = append(fs.Content, e)
+		}
+	}
 	defer fs.Close()
 
-	go func() {
-		last := 0
-		for {
+	if cmd == "duplicates" {
+		if err := duplicates(fs, flag.Arg(0)); err != nil {
+			logErr.Fatal(err)
+		}
+		return
+	} else if cmd != "" {
+		if err := transfer(fs, cmd, flag.Arg(0)); err != nil {
+			logErr.Fatal(err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if len(hooks) > 0 {
+		n, err := NewNotifier(fs, hooks)
+		if err != nil {
+			logErr.Fatal(err)
+		}
+		go n.Run(ctx)
+	}
+
+	var man *Manifests
+	if len(manifests) > 0 {
+		if man, err = NewManifests(fs, manifests); err != nil {
+			logErr.Fatal(err)
+		}
+		defer man.Close()
+		go man.Run(ctx)
+	}
+
+	var hk *Hooks
+	if *command != "" {
+		if hk, err = NewHooks(fs, *command); err != nil {
+			logErr.Fatal(err)
+		}
+		hk.Jobs = *execJobs
+		hk.Timeout = *execTime
+		go hk.Run(ctx)
+	}
+
+	var dup *Dupes
+	if *dupes {
+		dup = NewDupes(fs)
+		go dup.Run(ctx)
+	}
+
+	var an *Analytics
+	if *analytics > 0 {
+		if an, err = NewAnalytics(fs); err != nil {
+			logErr.Fatal(err)
+		}
+		an.Retention = *analytics
+		an.Anonymize = *anonymize
+		defer an.Close()
+		go an.Run(ctx)
+	}
+
+	snap := NewSnapshots(fs)
+	defer snap.Close()
+
+	var ev *Events
+	if *events > 0 {
+		ev = NewEvents(fs)
+		ev.MaxClients = *events
+	}
+
+	last := 0
+	fill := &sched.Scheduler{
+		Job: func() error {
 			n, err := fs.Fill()
-			if err != nil {
-				logErr.Printf("Fill: %s\n", err.Error())
-			}
-			if n != last {
+			if err == nil && n != last {
 				logErr.Printf("%d records in database after update (%+d)\n", n, n-last)
 				last = n
 			}
-			if interval == 0 {
-				break
+			return err
+		},
+		Schedule:   schedule,
+		Jitter:     *jitter,
+		Backoff:    *backoff,
+		MaxBackoff: *backMax,
+	}
+
+	go func() {
+		logFill := func(err error) { logErr.Printf("Fill: %s\n", err.Error()) }
+
+		// Serve an existing (e.g. imported) index as is if refreshes are disabled
+		if schedule != nil || !fs.DBReady() {
+			if err := fill.Do(); err != nil {
+				logFill(err)
+			}
+		}
+		fill.Run(ctx, logFill)
+	}()
+
+	for _, p := range subtrees {
+		p := p
+		last := -1
+		s := &sched.Scheduler{
+			Job: func() error {
+				n, err := fs.FillPath(p.Path)
+				if err == nil && n != last {
+					logErr.Printf("%d records in %s after update\n", n, p.Path)
+					last = n
+				}
+				return err
+			},
+			Schedule:   p.Schedule,
+			Jitter:     *jitter,
+			Backoff:    *backoff,
+			MaxBackoff: *backMax,
+		}
+		go s.Run(ctx, func(err error) { logErr.Printf("FillPath(%s): %s\n", p.Path, err.Error()) })
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+		for range sig {
+			logErr.Println("Refreshing index (SIGHUP)")
+			if err := fill.Do(); err != nil {
+				logErr.Printf("Fill: %s\n", err.Error())
 			}
-			time.Sleep(interval)
 		}
 	}()
 
@@ -92,8 +277,50 @@ func main() {
 	handleLimited := func(p string, h http.Handler) { handleDefault(p, limit.Handler(logRequest(http.StripPrefix(p, h)))) }
 
 	handleLimited("/idx/", fs)
-	handleLimited("/dl/", nodir(http.FileServer(http.Dir(fs.Root))))
+	dl := fs.Guard(fs.Gone(nodir(http.FileServer(http.Dir(fs.Root)))))
+	if an != nil {
+		dl = an.Downloads(dl)
+	}
+	handleLimited("/dl/", dl)
 	handleLimited("/urllist.txt", http.HandlerFunc(fs.Sitemap))
+	handleLimited("/feed/", http.HandlerFunc(fs.Feed))
+	handleLimited("/suggest/", http.HandlerFunc(fs.Suggest))
+	handleLimited("/opensearch.xml", http.HandlerFunc(OpenSearch))
+	handleLimited("/snapshot", snap)
+	if dup != nil {
+		handleLimited("/duplicates/", dup)
+	}
+	if man != nil {
+		handleLimited("/manifest/", man)
+		handleLimited("/ls-lR.gz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = "ls-lR.gz"
+			man.ServeHTTP(w, r)
+		}))
+	}
+	if ev != nil {
+		handleLimited("/events/", ev)
+	}
+	if *admin != "" {
+		handleLimited("/admin/cache", adminAuth(*admin, http.HandlerFunc(fs.ServeCacheStats)))
+		handleLimited("/admin/shrink", adminAuth(*admin, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logErr.Println("Refreshing index, allowing it to shrink (/admin/shrink)")
+			fs.AllowShrink()
+			go func() {
+				if err := fill.Do(); err != nil {
+					logErr.Printf("Fill: %s\n", err.Error())
+				}
+			}()
+
+			w.Header().Set("Cache-Control", "no-store")
+			http.Error(w, "202 Accepted", http.StatusAccepted)
+		})))
+		if hk != nil {
+			handleLimited("/admin/exec", adminAuth(*admin, hk))
+		}
+		if an != nil {
+			handleLimited("/admin/searches", adminAuth(*admin, an))
+		}
+	}
 	handleDefault("/", pub)
 
 	go func() {
@@ -101,6 +328,11 @@ func main() {
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 		<-sig
 
+		cancel()
+		if ev != nil {
+			ev.Close()
+		}
+
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 
@@ -113,6 +345,91 @@ func main() {
 	fs.Close()
 }
 
+// transfer exports the index to (or imports it from) file name, using stdout/stdin if name is empty or "-"
+func transfer(fs *CachedFS, cmd string, name string) error {
+	f := *format
+	if f == "" {
+		f = "ndjson"
+		if strings.HasSuffix(strings.TrimSuffix(name, ".gz"), ".csv") {
+			f = "csv"
+		}
+	}
+
+	if cmd == "import" {
+		if strings.Contains(*db, ":memory:") || strings.Contains(*db, "mode=memory") {
+			return errors.New("import requires a database file (-d)")
+		}
+
+		in := os.Stdin
+		if name != "" && name != "-" {
+			var err error
+			if in, err = os.Open(name); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+
+		n, err := fs.Import(in, f)
+		if err == nil {
+			logErr.Printf("%d records in database after import\n", n)
+		}
+		return err
+	}
+
+	// Build index from root directory if there is none yet
+	if !fs.DBReady() {
+		if _, err := fs.Fill(); err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if name != "" && name != "-" {
+		var err error
+		if out, err = os.Create(name); err != nil {
+			return err
+		}
+	}
+
+	b := bufio.NewWriter(out)
+	var w io.Writer = b
+	var z *gzip.Writer
+	if strings.HasSuffix(name, ".gz") {
+		z = gzip.NewWriter(b)
+		w = z
+	}
+
+	err := fs.Export(context.Background(), w, f)
+	if err == nil && z != nil {
+		err = z.Close()
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// duplicates prints the duplicate files in subtree dir
+func duplicates(fs *CachedFS, dir string) error {
+	if !fs.DBReady() {
+		if _, err := fs.Fill(); err != nil {
+			return err
+		}
+	}
+
+	r, err := fs.Duplicates(context.Background())
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r.Under(cleanPath(dir)))
+}
+
 func orHyphen(s string) string {
 	if s != "" {
 		return s
@@ -148,6 +465,20 @@ func realIP(trustForward bool, han http.Handler) http.Handler {
 	})
 }
 
+// adminAuth only lets requests authenticated with password (HTTP basic auth) through to han
+func adminAuth(password string, han http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pw, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(pw), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="autoindex", charset="UTF-8"`)
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		han.ServeHTTP(w, r)
+	})
+}
+
 func nodir(han http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
@@ -0,0 +1,388 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifest file names and their content types
+var manifestTypes = map[string]string{
+	"ls-lR.gz": "application/gzip",
+	"mtree":    "text/plain; charset=utf-8",
+	"find.txt": "text/plain; charset=utf-8",
+}
+
+// Path prefix list (flag.Value)
+type prefixes []string
+
+func (s *prefixes) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *prefixes) Set(v string) error {
+	*s = append(*s, cleanPath(v))
+	return nil
+}
+
+type manifest struct {
+	gen   int64
+	time  time.Time
+	files map[string]string
+}
+
+// Manifests generates mirror manifests (ls-lR.gz, mtree and find-style lists) for
+// a number of subtrees from the index, after every published generation
+type Manifests struct {
+	fs   *CachedFS
+	subs []string
+	tmp  string
+	wake chan struct{}
+	mut  sync.RWMutex
+	man  map[string]*manifest
+}
+
+// NewManifests for the given subtrees of fs
+func NewManifests(fs *CachedFS, subs []string) (*Manifests, error) {
+	tmp, err := os.MkdirTemp("", "autoindex-manifest-")
+	if err != nil {
+		return nil, err
+	}
+
+	m := Manifests{
+		fs:   fs,
+		subs: subs,
+		tmp:  tmp,
+		wake: make(chan struct{}, 1),
+		man:  make(map[string]*manifest),
+	}
+
+	fs.OnPublish(func(gen int64) {
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	})
+
+	return &m, nil
+}
+
+// Close removes the generated manifests
+func (m *Manifests) Close() error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	m.man = make(map[string]*manifest)
+	return os.RemoveAll(m.tmp)
+}
+
+// comparePaths orders directory paths like a recursive listing (collation "paths"),
+// with every directory followed by its subdirectories: /a/, /a/b/, /a b/
+func comparePaths(a string, b string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i] == b[i]:
+			continue
+		case a[i] == '/':
+			return -1
+		case b[i] == '/':
+			return 1
+		case a[i] < b[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	return len(a) - len(b)
+}
+
+// lsTime formats t like ls -l does, relative to now
+func lsTime(t time.Time, now time.Time) string {
+	if t.After(now.Add(time.Hour)) || now.Sub(t) > 183*24*time.Hour {
+		return t.Format("Jan _2  2006")
+	}
+	return t.Format("Jan _2 15:04")
+}
+
+// mtreeEscape encodes special characters in a file name as octal escapes
+func mtreeEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '#' || c == '*' || c == '?' || c == '[' {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type manifestWriter struct {
+	f *os.File
+	b *bufio.Writer
+	z *gzip.Writer
+}
+
+func (w *manifestWriter) close() error {
+	err := w.z.Close()
+	if err == nil {
+		err = w.b.Flush()
+	}
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// generate writes the manifests of subtree sub, for generation gen read from db
+func (m *Manifests) generate(ctx context.Context, db queryer, sub string, gen int64) (*manifest, error) {
+	now := time.Now()
+	res := manifest{gen: gen, time: now, files: make(map[string]string)}
+
+	done := false
+	out := make(map[string]*manifestWriter)
+	defer func() {
+		for _, w := range out {
+			w.f.Close()
+		}
+		if !done {
+			for _, f := range res.files {
+				os.Remove(f)
+			}
+		}
+	}()
+
+	for name := range manifestTypes {
+		f, err := os.CreateTemp(m.tmp, "*-"+name)
+		if err != nil {
+			return nil, err
+		}
+		b := bufio.NewWriter(f)
+		out[name] = &manifestWriter{f: f, b: b, z: gzip.NewWriter(b)}
+		res.files[name] = f.Name()
+	}
+
+	ls := out["ls-lR.gz"].z
+	mt := out["mtree"].z
+	fd := out["find.txt"].z
+
+	fmt.Fprintf(mt, "#mtree\n/set type=file uid=0 gid=0 mode=0644\n. type=dir mode=0755\n")
+	fmt.Fprintf(fd, ".\n")
+
+	rows, err := db.QueryContext(ctx, "SELECT dirs.path, files.name, files.dir, files.size, files.mtime FROM dirs LEFT JOIN files ON files.root = dirs.rowid WHERE dirs.path GLOB ? ORDER BY dirs.path COLLATE paths, files.name", escapeGlob(sub)+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// ls -lR prints a total before the entries of every directory
+	var cur string
+	var total int64
+	var section bytes.Buffer
+	flush := func() {
+		if cur == "" {
+			return
+		}
+		if cur != sub {
+			ls.Write([]byte{'\n'})
+		}
+		fmt.Fprintf(ls, ".%s:\ntotal %d\n", strings.TrimSuffix(cur[len(sub)-1:], "/"), total)
+		ls.Write(section.Bytes())
+		section.Reset()
+		total = 0
+	}
+
+	for rows.Next() {
+		var root string
+		var name sql.NullString
+		var dir sql.NullBool
+		var size, mtime sql.NullInt64
+		if err := rows.Scan(&root, &name, &dir, &size, &mtime); err != nil {
+			return nil, err
+		}
+
+		if root != cur {
+			flush()
+			cur = root
+		}
+
+		// Empty directory
+		if !name.Valid {
+			continue
+		}
+
+		rel := "." + root[len(sub)-1:] + name.String
+		t := time.Unix(mtime.Int64, 0).UTC()
+
+		if dir.Bool {
+			fmt.Fprintf(&section, "drwxr-xr-x 1 root root %8d %s %s\n", size.Int64, lsTime(t, now), name.String)
+			fmt.Fprintf(mt, "%s type=dir mode=0755 time=%d.000000000\n", mtreeEscape(rel), mtime.Int64)
+		} else {
+			fmt.Fprintf(&section, "-rw-r--r-- 1 root root %8d %s %s\n", size.Int64, lsTime(t, now), name.String)
+			fmt.Fprintf(mt, "%s size=%d time=%d.000000000\n", mtreeEscape(rel), size.Int64, mtime.Int64)
+		}
+		fmt.Fprintf(fd, "%s\n", rel)
+
+		total += (size.Int64 + 1023) / 1024
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if cur == "" {
+		return nil, os.ErrNotExist
+	}
+	flush()
+
+	for name, w := range out {
+		delete(out, name)
+		if err := w.close(); err != nil {
+			return nil, err
+		}
+	}
+
+	done = true
+	return &res, nil
+}
+
+// Generate the manifests of every subtree for the current generation
+func (m *Manifests) Generate(ctx context.Context) error {
+	// A single read transaction sees the generation and its entries, without blocking refreshes
+	tx, err := m.fs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var gen int64
+	if err := tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(gen), 0) FROM generations").Scan(&gen); err != nil {
+		return err
+	}
+
+	for _, sub := range m.subs {
+		m.mut.RLock()
+		old := m.man[sub]
+		m.mut.RUnlock()
+		if old != nil && old.gen == gen {
+			continue
+		}
+
+		man, err := m.generate(ctx, tx, sub, gen)
+		if err == os.ErrNotExist {
+			logErr.Printf("Manifest: %s not found in index\n", sub)
+		} else if err != nil {
+			return err
+		}
+
+		m.mut.Lock()
+		m.man[sub] = man
+		m.mut.Unlock()
+
+		// Readers of the previous manifests keep their open handle
+		if old != nil {
+			for _, f := range old.files {
+				os.Remove(f)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run regenerates the manifests after every published generation, until ctx is done
+func (m *Manifests) Run(ctx context.Context) {
+	for {
+		if m.fs.DBReady() {
+			if err := m.Generate(ctx); err != nil && ctx.Err() == nil {
+				logErr.Printf("Manifest: %s\n", err.Error())
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		}
+	}
+}
+
+// open the manifest file of subtree sub
+func (m *Manifests) open(sub string, name string) (*os.File, *manifest, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	man := m.man[sub]
+	if man == nil || man.files[name] == "" {
+		return nil, nil, os.ErrNotExist
+	}
+
+	f, err := os.Open(man.files[name])
+	return f, man, err
+}
+
+// ServeHTTP serves <subtree>/ls-lR.gz, <subtree>/mtree or <subtree>/find.txt
+func (m *Manifests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dir, name := path.Split(r.URL.Path)
+	ctype, ok := manifestTypes[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, man, err := m.open(cleanPath(dir), name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Cache-Control", "max-age=300")
+	etag := "\"" + strconv.FormatInt(man.gen, 10)
+
+	if strings.HasSuffix(name, ".gz") {
+		w.Header().Set("ETag", etag+"\"")
+		http.ServeContent(w, r, "", man.time, f)
+		return
+	}
+
+	// Plain text manifests are stored compressed, with a distinct tag per encoding
+	w.Header().Set("Vary", "Accept-Encoding")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("ETag", etag+"-gzip\"")
+		w.Header().Set("Content-Encoding", "gzip")
+		http.ServeContent(w, r, "", man.time, f)
+		return
+	}
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	defer z.Close()
+
+	w.Header().Set("ETag", etag+"\"")
+	w.Header().Set("Last-Modified", man.time.UTC().Format(http.TimeFormat))
+	if r.Method != http.MethodHead {
+		io.Copy(w, z)
+	}
+}
@@ -0,0 +1,132 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifests(t *testing.T) {
+	fs, root := newTestFS(t, "pub/sub/", "pub/sub x/", "private/")
+	for name, size := range map[string]int{"pub/a.txt": 1500, "pub/sp ace.txt": 0, "pub/sub/b.txt": 10, "pub/sub x/c.txt": 1, "private/c.txt": 1} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"pub/sub/b.txt", "pub/sub x/c.txt", "pub/sp ace.txt", "pub/a.txt", "pub/sub", "pub/sub x", "pub"} {
+		if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(name)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fill(t, fs)
+
+	m, err := NewManifests(fs, []string{cleanPath("pub"), cleanPath("missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := m.Generate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directory sizes depend on the file system
+	st, err := os.Stat(filepath.Join(root, "pub", "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsize := st.Size()
+
+	get := func(u string, status int) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != status {
+			t.Fatalf("%s: Expected status %d, got %d\n", u, status, w.Code)
+		}
+		var r io.Reader = w.Body
+		if strings.HasSuffix(u, ".gz") && status == http.StatusOK {
+			z, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = z
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	for _, c := range []struct {
+		name string
+		want string
+	}{
+		{"ls-lR.gz", ".:\n" +
+			fmt.Sprintf("total %d\n", 2+2*((dsize+1023)/1024)) +
+			"-rw-r--r-- 1 root root     1500 Jan  2  2020 a.txt\n" +
+			"-rw-r--r-- 1 root root        0 Jan  2  2020 sp ace.txt\n" +
+			fmt.Sprintf("drwxr-xr-x 1 root root %8d Jan  2  2020 sub\n", dsize) +
+			fmt.Sprintf("drwxr-xr-x 1 root root %8d Jan  2  2020 sub x\n", dsize) +
+			"\n" +
+			"./sub:\n" +
+			"total 1\n" +
+			"-rw-r--r-- 1 root root       10 Jan  2  2020 b.txt\n" +
+			"\n" +
+			"./sub x:\n" +
+			"total 1\n" +
+			"-rw-r--r-- 1 root root        1 Jan  2  2020 c.txt\n"},
+		{"mtree", "#mtree\n" +
+			"/set type=file uid=0 gid=0 mode=0644\n" +
+			". type=dir mode=0755\n" +
+			"./a.txt size=1500 time=1577934245.000000000\n" +
+			"./sp\\040ace.txt size=0 time=1577934245.000000000\n" +
+			"./sub type=dir mode=0755 time=1577934245.000000000\n" +
+			"./sub\\040x type=dir mode=0755 time=1577934245.000000000\n" +
+			"./sub/b.txt size=10 time=1577934245.000000000\n" +
+			"./sub\\040x/c.txt size=1 time=1577934245.000000000\n"},
+		{"find.txt", ".\n" +
+			"./a.txt\n" +
+			"./sp ace.txt\n" +
+			"./sub\n" +
+			"./sub x\n" +
+			"./sub/b.txt\n" +
+			"./sub x/c.txt\n"},
+	} {
+		if got := get("/pub/"+c.name, http.StatusOK); got != c.want {
+			t.Errorf("%s: Expected\n%s\ngot\n%s\n", c.name, c.want, got)
+		}
+	}
+
+	// Compressed and plain responses are different representations
+	etag := func(enc string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/pub/find.txt", nil)
+		r.Header.Set("Accept-Encoding", enc)
+		m.ServeHTTP(w, r)
+		return w.Header().Get("ETag")
+	}
+	if plain, gz := etag(""), etag("gzip"); plain == "" || gz == "" || plain == gz {
+		t.Errorf("Expected distinct ETags, got %s and %s\n", plain, gz)
+	}
+
+	get("/private/find.txt", http.StatusNotFound)
+	get("/missing/find.txt", http.StatusNotFound)
+	get("/pub/other.txt", http.StatusNotFound)
+}
@@ -0,0 +1,28 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+//go:build darwin || freebsd || linux || netbsd || openbsd
+// +build darwin freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+func isMountpoint(name string) (bool, error) {
+	var st, pt syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil {
+		return false, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	parent := filepath.Join(name, "..")
+	if err := syscall.Stat(parent, &pt); err != nil {
+		return false, &os.PathError{Op: "stat", Path: parent, Err: err}
+	}
+
+	// Different device than its parent, or the file system root itself
+	return st.Dev != pt.Dev || st.Ino == pt.Ino, nil
+}
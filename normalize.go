@@ -0,0 +1,93 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// newFolder returns a transformer that strips diacritics and case folds text, in NFC
+func newFolder() transform.Transformer {
+	strip := runes.Remove(runes.In(unicode.Mn))
+	return transform.Chain(norm.NFD, strip, cases.Fold(), norm.NFD, strip, norm.NFC)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// foldSpans normalizes s for searching (see fold). If spans is not nil, it is set to the
+// range of s that every byte of the result originates from.
+func foldSpans(s string, spans *[][2]int) string {
+	if isASCII(s) {
+		if spans != nil {
+			*spans = make([][2]int, len(s))
+			for i := range s {
+				(*spans)[i] = [2]int{i, i + 1}
+			}
+		}
+		return strings.ToLower(s)
+	}
+
+	// Fold every segment between normalization boundaries on its own, so the result can be
+	// mapped back to s (and a byte of the result never depends on more than its segment)
+	var b strings.Builder
+	t := newFolder()
+	if spans != nil {
+		*spans = (*spans)[:0]
+	}
+	for i := 0; i < len(s); {
+		n := norm.NFC.NextBoundaryInString(s[i:], true)
+		if n <= 0 {
+			n = len(s) - i
+		}
+
+		t.Reset()
+		f, _, err := transform.String(t, s[i:i+n])
+		if err != nil {
+			f = s[i : i+n]
+		}
+		b.WriteString(f)
+
+		if spans != nil {
+			for range []byte(f) {
+				*spans = append(*spans, [2]int{i, i + n})
+			}
+		}
+		i += n
+	}
+	return b.String()
+}
+
+// fold normalizes s for searching: composed (NFC), case folded and without diacritics,
+// so "Élan", "elan" and an NFD encoded "élan" are all the same
+func fold(s string) string {
+	return foldSpans(s, nil)
+}
+
+// foldPrefix returns the length of the prefix of s that folds to n bytes (or more)
+func foldPrefix(s string, n int) int {
+	var spans [][2]int
+	f := foldSpans(s, &spans)
+	if n <= 0 {
+		return 0
+	}
+	if n > len(f) {
+		return len(s)
+	}
+	return spans[n-1][1]
+}
@@ -0,0 +1,32 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import "testing"
+
+func TestFold(t *testing.T) {
+	for s, f := range map[string]string{
+		"ÉLAN":          "elan",
+		"e\u0301lan":    "elan",
+		"Café":          "cafe",
+		"Straße":        "strasse",
+		"İstanbul":      "istanbul",
+		"ΣΊΣΥΦΟΣ":       "σισυφοσ",
+		"Ångström.TXT":  "angstrom.txt",
+		"\u1100\u1161":  "가",
+		"plain_ascii-1": "plain_ascii-1",
+	} {
+		if r := fold(s); r != f {
+			t.Errorf("fold(%q) = %q, expected %q\n", s, r, f)
+		}
+	}
+
+	// Match offsets map back to the original name
+	name := "Café Ünïcode"
+	score, m := rank(name, []term{{text: "cafe"}, {text: "unic"}})
+	if score == 0 || len(m) != 2 || m[0] != [2]int{0, 5} || m[1] != [2]int{6, 10} {
+		t.Errorf("Unexpected rank %v %v\n", score, m)
+	}
+}
@@ -1,17 +1,25 @@
 "use strict";
 const search = RegExp("[?&]q=([^&]+)");
-function setPath(crumbs, files, q, path, query) {
+let events = null;
+function setPath(crumbs, files, q, path, query, reload) {
 	if (document.location.pathname != path || document.location.search != query) {
 		history.pushState({}, document.title, path + query);
 		path = document.location.pathname;
 	}
 
 	document.body.classList.add("loading");
-	window.scrollTo(0, 0);
+	if (!reload) window.scrollTo(0, 0);
 
-	function a(sp, href, text, cls, rel) {
+	function a(sp, href, text, cls, rel, m) {
 		let r = document.createElement("a");
-		r.appendChild(document.createTextNode(text.replace(/_/g, " ")));
+		text = text.replace(/_/g, " ");
+		let j = 0;
+		for (let i = 0; m && i < m.length; i++) {
+			r.appendChild(document.createTextNode(text.substring(j, m[i][0])));
+			r.appendChild(document.createElement("mark")).appendChild(document.createTextNode(text.substring(m[i][0], m[i][1])));
+			j = m[i][1];
+		}
+		r.appendChild(document.createTextNode(text.substring(j)));
 		r.setAttribute("href", href);
 		if (rel) r.setAttribute("rel", rel);
 		if (cls) r.classList.add(cls);
@@ -67,10 +75,13 @@ function setPath(crumbs, files, q, path, query) {
 		for (let i = 0; i < json.length; i++) {
 			const n = json[i].name
 			const p = path+encodeURIComponent(json[i].name);
+			let li;
 			if ((json[i].type||"")[0] == "f")
-				f.appendChild(el("li", a(false, "/dl/"+p, n, "f", "nofollow")));
+				li = f.appendChild(el("li", a(false, "/dl/"+p, n, "f", "nofollow", json[i].matches)));
 			else
-				f.appendChild(el("li", a(true, "/"+p.replace(/%2F/gi, "/"), n, "d", "")));
+				li = f.appendChild(el("li", a(true, "/"+p.replace(/%2F/gi, "/"), n, "d", "", json[i].matches)));
+			if (json[i].gone) li.classList.add("g");
+			if (json[i].snippet) li.appendChild(el("small", document.createTextNode(json[i].snippet)));
 		}
 
 		if (f.childNodes.length) {
@@ -78,12 +89,51 @@ function setPath(crumbs, files, q, path, query) {
 			files.appendChild(f);
 		} else {
 			files.innerHTML="<li class=error>No files found</li>";
+
+			// Did you mean ..?
+			const alts = (this.getResponseHeader("X-Did-You-Mean")||"").split(/,\s*/).filter(Boolean);
+			if (alts.length) {
+				let li = files.appendChild(el("li", document.createTextNode("Did you mean ")));
+				li.classList.add("alt");
+				for (let i = 0; i < alts.length; i++) {
+					const alt = decodeURIComponent(alts[i]);
+					const s = "?r=1&q=" + encodeURIComponent(alt);
+					let r = li.appendChild(el("a", document.createTextNode(alt)));
+					r.setAttribute("href", s);
+					r.addEventListener("click", function(e){
+						e.preventDefault();
+						setPath(crumbs, files, q, document.location.pathname, s);
+					});
+					li.appendChild(document.createTextNode((i < alts.length-1) ? ", " : "?"));
+				}
+			}
 		}
 	};
 
 	if (path) path += "/"
 	req.open("GET", "/idx/" + path + query, true);
 	req.send();
+
+	const feed = document.getElementById("feed");
+	if (feed) feed.setAttribute("href", "/feed/" + path + (s ? "?q=" + encodeURIComponent(s) : ""));
+
+	// Live updates of the open directory
+	const ev = (s || !window.EventSource) ? "" : "/events/" + path;
+	if (events && events.url != ev) {
+		events.source.close();
+		events = null;
+	}
+	if (ev && !events) {
+		events = {url: ev, source: new EventSource(ev), timer: 0};
+		const update = function() {
+			clearTimeout(events.timer);
+			events.timer = setTimeout(function() {
+				setPath(crumbs, files, q, document.location.pathname, document.location.search, true);
+			}, 500);
+		};
+		for (const e of ["added", "removed", "modified", "refresh"])
+			events.source.addEventListener(e, update);
+	}
 }
 function onLoad() {
 	const path   = document.getElementById("path");
@@ -96,6 +146,26 @@ function onLoad() {
 		setPath(path, files, q, document.location.pathname, document.location.search);
 	});
 
+	// Search-as-you-type suggestions
+	const list = document.getElementById("suggest");
+	let typing = null;
+	q.addEventListener("input", function(e) {
+		clearTimeout(typing);
+		typing = setTimeout(function() {
+			if (!q.value) return;
+			const req = new XMLHttpRequest();
+			req.onreadystatechange = function() {
+				if (this.readyState != 4 || this.status != 200) return;
+				const json = JSON.parse(this.responseText || "[]");
+				list.innerHTML = "";
+				for (let i = 0; json[1] && i < json[1].length; i++)
+					list.appendChild(document.createElement("option")).value = json[1][i];
+			};
+			req.open("GET", "/suggest" + document.location.pathname.replace(/\/*$/, "/") + "?q=" + encodeURIComponent(q.value), true);
+			req.send();
+		}, 250);
+	});
+
 	search.addEventListener("submit", function(e) {
 		e.preventDefault();
 		const s = q.value ? "?r=1&q=" + encodeURIComponent(q.value) : "";
@@ -0,0 +1,887 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Errors
+var (
+	ErrQuery        = errors.New("invalid search query")
+	ErrQueryComplex = errors.New("search query too complex")
+)
+
+// Maximum number of terms in a search query
+const queryTerms = 32
+
+// Query is a node of a parsed search query:
+//
+//	query   = or
+//	or      = and {"OR" and}
+//	and     = {unary}
+//	unary   = "-" unary | "(" or ")" | field ":" value | phrase | word
+//	field   = "ext" | "type" | "size" | "mtime" | "path" | "content"
+type Query interface {
+	// where compiles the node to an SQL condition on files (joined with dirs)
+	where(c *queryCompiler) string
+
+	// match reports whether live entry e matches the node
+	match(e *queryEntry) bool
+}
+
+type (
+	queryAnd []Query
+	queryOr  []Query
+	queryNot struct{ x Query }
+
+	// Word or "quoted phrase", with the byte offset of the word in the query
+	queryWord struct {
+		raw    string
+		pos    int
+		phrase bool
+		terms  []term
+	}
+
+	// ext:iso,img (folded)
+	queryExt []string
+
+	// type:d
+	queryType bool
+
+	// size:>1G or mtime:2020..2022, as an interval [lo, hi) of the column
+	queryRange struct {
+		col string
+		lo  int64
+		hi  int64
+	}
+
+	// path:releases/ (folded)
+	queryPath string
+
+	// content:word or content:"quoted phrase", with its folded words
+	queryContent struct {
+		raw    string
+		phrase bool
+		words  []string
+	}
+)
+
+// queryCompiler collects the arguments of the compiled SQL
+type queryCompiler struct {
+	args []interface{}
+
+	// Match words as substrings of the name, rather than by their tokens
+	substr bool
+}
+
+func (c *queryCompiler) arg(a ...interface{}) {
+	c.args = append(c.args, a...)
+}
+
+// compileQuery compiles q to an SQL condition on files (joined with dirs) and its arguments
+func compileQuery(q Query, substr bool) (string, []interface{}) {
+	c := queryCompiler{substr: substr}
+	return q.where(&c), c.args
+}
+
+// likeLiteral escapes s for use in a LIKE pattern (with ESCAPE '`')
+func likeLiteral(s string) string {
+	return escLike.ReplaceAllStringFunc(s, func(m string) string { return "`" + m })
+}
+
+// likeContains returns a LIKE pattern matching s anywhere
+func likeContains(s string) string {
+	return "%" + likeLiteral(s) + "%"
+}
+
+func (q queryAnd) where(c *queryCompiler) string {
+	s := make([]string, len(q))
+	for i, x := range q {
+		s[i] = x.where(c)
+	}
+	return "(" + strings.Join(s, " AND ") + ")"
+}
+
+func (q queryOr) where(c *queryCompiler) string {
+	s := make([]string, len(q))
+	for i, x := range q {
+		s[i] = x.where(c)
+	}
+	return "(" + strings.Join(s, " OR ") + ")"
+}
+
+func (q queryNot) where(c *queryCompiler) string {
+	return "NOT " + q.x.where(c)
+}
+
+func (q *queryWord) where(c *queryCompiler) string {
+	if c.substr || len(q.terms) == 0 {
+		c.arg(likeContains(fold(q.raw)))
+		return "files.search LIKE ? ESCAPE '`'"
+	}
+
+	// Every term must match the name, or be part of the path
+	s := make([]string, len(q.terms))
+	for i := range q.terms {
+		s[i] = "(" + q.terms[i].where(c) + " OR dirs.search LIKE ? ESCAPE '`')"
+		c.arg(likeContains(q.terms[i].text))
+	}
+	return "(" + strings.Join(s, " AND ") + ")"
+}
+
+func (q queryExt) where(c *queryCompiler) string {
+	s := make([]string, len(q))
+	for i, e := range q {
+		s[i] = "files.search LIKE ? ESCAPE '`'"
+		c.arg("%" + likeLiteral("."+e))
+	}
+	return "(NOT files.dir AND (" + strings.Join(s, " OR ") + "))"
+}
+
+func (q queryType) where(c *queryCompiler) string {
+	c.arg(bool(q))
+	return "files.dir = ?"
+}
+
+func (q *queryRange) where(c *queryCompiler) string {
+	c.arg(q.lo, q.hi)
+	s := "(files." + q.col + " >= ? AND files." + q.col + " < ?)"
+	if q.col == "size" {
+		s = "(NOT files.dir AND " + s + ")"
+	}
+	return s
+}
+
+func (q queryPath) where(c *queryCompiler) string {
+	if strings.HasPrefix(string(q), "/") {
+		c.arg(likeLiteral(string(q)) + "%")
+	} else {
+		c.arg(likeContains(string(q)))
+	}
+	return "(dirs.search || files.search) LIKE ? ESCAPE '`'"
+}
+
+func (q *queryContent) where(c *queryCompiler) string {
+	s := make([]string, 0, len(q.words)+1)
+	for _, w := range q.words {
+		s = append(s, "files.rowid IN (SELECT file FROM ctokens WHERE token GLOB ?)")
+		c.arg(escapeGlob(w) + "*")
+	}
+	if q.phrase || len(q.words) == 0 {
+		s = append(s, "EXISTS (SELECT 1 FROM content WHERE content.path = dirs.path || files.name AND content.search LIKE ? ESCAPE '`')")
+		c.arg(likeContains(fold(q.raw)))
+	}
+	return "(" + strings.Join(s, " AND ") + ")"
+}
+
+// queryEntry is an entry of a live directory listing
+type queryEntry struct {
+	name string
+	dir  bool
+
+	// Full path (relative to root) of the directory the entry is in
+	root string
+
+	// Path of the entry on disk
+	file string
+
+	tokens []token
+	folded string
+	stat   bool
+	size   int64
+	mtime  int64
+}
+
+// fold returns the folded name of e
+func (e *queryEntry) fold() string {
+	if e.tokens == nil {
+		e.tokens = tokenize(e.name)
+		e.folded = fold(e.name)
+	}
+	return e.folded
+}
+
+func (e *queryEntry) stats() (int64, int64) {
+	if !e.stat {
+		e.size, e.mtime = stat(e.file)
+		e.stat = true
+	}
+	return e.size, e.mtime
+}
+
+func (q queryAnd) match(e *queryEntry) bool {
+	for _, x := range q {
+		if !x.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q queryOr) match(e *queryEntry) bool {
+	for _, x := range q {
+		if x.match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q queryNot) match(e *queryEntry) bool {
+	return !q.x.match(e)
+}
+
+func (q *queryWord) match(e *queryEntry) bool {
+	name := e.fold()
+	if strings.Contains(name, fold(q.raw)) {
+		return true
+	}
+	if len(q.terms) == 0 {
+		return false
+	}
+
+	root := fold(e.root)
+	for i := range q.terms {
+		if !q.terms[i].matches(e.tokens, name) && !strings.Contains(root, q.terms[i].text) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q queryExt) match(e *queryEntry) bool {
+	if e.dir {
+		return false
+	}
+	ext := e.fold()
+	for _, x := range q {
+		if strings.HasSuffix(ext, "."+x) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q queryType) match(e *queryEntry) bool {
+	return e.dir == bool(q)
+}
+
+func (q *queryRange) match(e *queryEntry) bool {
+	if q.col == "size" && e.dir {
+		return false
+	}
+
+	size, mtime := e.stats()
+	v := mtime
+	if q.col == "size" {
+		v = size
+	}
+	return v >= q.lo && v < q.hi
+}
+
+func (q queryPath) match(e *queryEntry) bool {
+	full := fold(e.root) + e.fold()
+	if strings.HasPrefix(string(q), "/") {
+		return strings.HasPrefix(full, string(q))
+	}
+	return strings.Contains(full, string(q))
+}
+
+// match never succeeds, contents are only searched in the index (see serveLive)
+func (q *queryContent) match(e *queryEntry) bool {
+	return false
+}
+
+// walkWords calls f for every word in q, skipping excluded words unless all is set
+func walkWords(q Query, all bool, f func(w *queryWord)) {
+	switch q := q.(type) {
+	case queryAnd:
+		for _, x := range q {
+			walkWords(x, all, f)
+		}
+	case queryOr:
+		for _, x := range q {
+			walkWords(x, all, f)
+		}
+	case queryNot:
+		if all {
+			walkWords(q.x, all, f)
+		}
+	case *queryWord:
+		f(q)
+	}
+}
+
+// rankTerms returns the terms of the words in q that results are ranked by
+func rankTerms(q Query) []term {
+	var res []term
+	walkWords(q, false, func(w *queryWord) {
+		res = append(res, w.terms...)
+	})
+	return res
+}
+
+type queryParser struct {
+	s     string
+	pos   int
+	depth int
+	terms int
+}
+
+// parseQuery parses search query s, returning nil for an empty query
+func parseQuery(s string) (Query, error) {
+	p := queryParser{s: s}
+	return p.or()
+}
+
+func (p *queryParser) space() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// end reports whether the current term ends at byte i
+func (p *queryParser) end(i int) bool {
+	return i >= len(p.s) || unicode.IsSpace(rune(p.s[i])) || (p.depth > 0 && p.s[i] == ')')
+}
+
+// keyword reports whether the next term is keyword k, skipping it if so
+func (p *queryParser) keyword(k string) bool {
+	p.space()
+	if strings.HasPrefix(p.s[p.pos:], k) && p.end(p.pos+len(k)) {
+		p.pos += len(k)
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) or() (Query, error) {
+	var res queryOr
+	for {
+		x, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		if x != nil {
+			res = append(res, x)
+		}
+		if !p.keyword("OR") {
+			break
+		}
+	}
+
+	switch len(res) {
+	case 0:
+		return nil, nil
+	case 1:
+		return res[0], nil
+	default:
+		return res, nil
+	}
+}
+
+func (p *queryParser) and() (Query, error) {
+	var res queryAnd
+	for {
+		p.space()
+		if p.pos >= len(p.s) || (p.depth > 0 && p.s[p.pos] == ')') {
+			break
+		}
+		if p.keyword("OR") {
+			p.pos -= len("OR")
+			break
+		}
+
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if x != nil {
+			res = append(res, x)
+		}
+	}
+
+	switch len(res) {
+	case 0:
+		return nil, nil
+	case 1:
+		return res[0], nil
+	default:
+		return res, nil
+	}
+}
+
+func (p *queryParser) unary() (Query, error) {
+	switch {
+	case p.s[p.pos] == '-' && !p.end(p.pos+1):
+		p.pos++
+		x, err := p.unary()
+		if x == nil || err != nil {
+			return nil, err
+		}
+		return queryNot{x}, nil
+
+	case p.s[p.pos] == '(':
+		p.pos++
+		p.depth++
+		x, err := p.or()
+		p.depth--
+		if p.pos < len(p.s) && p.s[p.pos] == ')' {
+			p.pos++
+		}
+		return x, err
+
+	default:
+		p.terms++
+		if p.terms > queryTerms {
+			return nil, ErrQueryComplex
+		}
+		return p.term()
+	}
+}
+
+// value reads a bare or quoted value
+func (p *queryParser) value() (string, bool) {
+	if p.pos < len(p.s) && p.s[p.pos] == '"' {
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end < 0 {
+			end = len(p.s) - p.pos - 1
+		}
+		v := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		if p.pos > len(p.s) {
+			p.pos = len(p.s)
+		}
+		return v, true
+	}
+
+	start := p.pos
+	for !p.end(p.pos) {
+		p.pos++
+	}
+	return p.s[start:p.pos], false
+}
+
+var queryField = regexp.MustCompile(`^(ext|type|size|mtime|path|content):`)
+
+func (p *queryParser) term() (Query, error) {
+	if f := queryField.FindString(p.s[p.pos:]); f != "" && !p.end(p.pos+len(f)) {
+		p.pos += len(f)
+		v, phrase := p.value()
+		if f == "content:" {
+			return parseContent(v, phrase)
+		}
+		return parseField(f[:len(f)-1], v, time.Now())
+	}
+
+	pos := p.pos
+	raw, phrase := p.value()
+	if phrase {
+		pos++
+	}
+	if raw == "" {
+		return nil, nil
+	}
+
+	w := queryWord{raw: raw, pos: pos, phrase: phrase}
+	if phrase {
+		w.terms = []term{{text: fold(raw), phrase: true}}
+	} else {
+		for _, t := range tokenize(raw) {
+			w.terms = append(w.terms, term{text: t.text, pos: pos + t.start})
+		}
+	}
+	return &w, nil
+}
+
+// parseField parses the value v of field f, relative to the current time now
+func parseField(f string, v string, now time.Time) (Query, error) {
+	switch f {
+	case "ext":
+		var res queryExt
+		for _, e := range strings.Split(fold(v), ",") {
+			if e = strings.TrimPrefix(e, "."); e != "" {
+				res = append(res, e)
+			}
+		}
+		if len(res) == 0 {
+			return nil, ErrQuery
+		}
+		return res, nil
+
+	case "type":
+		switch strings.ToLower(v) {
+		case "d", "dir", "directory":
+			return queryType(true), nil
+		case "f", "file":
+			return queryType(false), nil
+		}
+		return nil, ErrQuery
+
+	case "size", "mtime":
+		parse := parseSize
+		if f == "mtime" {
+			parse = func(s string) (int64, int64, error) { return parseDate(s, now) }
+		}
+		lo, hi, err := parseRange(v, parse)
+		if err != nil {
+			return nil, err
+		}
+		return &queryRange{col: f, lo: lo, hi: hi}, nil
+
+	case "path":
+		if v == "" {
+			return nil, ErrQuery
+		}
+		return queryPath(fold(v)), nil
+	}
+
+	return nil, ErrQuery
+}
+
+// parseContent parses the value v of a content field, a phrase if it was quoted
+func parseContent(v string, phrase bool) (Query, error) {
+	if strings.TrimSpace(v) == "" {
+		return nil, ErrQuery
+	}
+
+	q := queryContent{raw: v, phrase: phrase}
+	for _, t := range tokenize(v) {
+		q.words = append(q.words, t.text)
+	}
+	return &q, nil
+}
+
+// parseRange parses a comparison (>v, >=v, <v, <=v, v) or range (a..b, a.. or ..b) of values, where
+// parse returns the interval [start, end) a value denotes, into a single interval
+func parseRange(v string, parse func(string) (int64, int64, error)) (int64, int64, error) {
+	if i := strings.Index(v, ".."); i >= 0 {
+		lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+		var err error
+		if a := v[:i]; a != "" {
+			if lo, _, err = parse(a); err != nil {
+				return 0, 0, err
+			}
+		}
+		if b := v[i+2:]; b != "" {
+			if _, hi, err = parse(b); err != nil {
+				return 0, 0, err
+			}
+		}
+		return lo, hi, nil
+	}
+
+	op := ""
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(v, o) {
+			op = o
+			break
+		}
+	}
+
+	start, end, err := parse(v[len(op):])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch op {
+	case ">":
+		return end, math.MaxInt64, nil
+	case ">=":
+		return start, math.MaxInt64, nil
+	case "<":
+		return math.MinInt64, start, nil
+	case "<=":
+		return math.MinInt64, end, nil
+	default:
+		return start, end, nil
+	}
+}
+
+var sizeUnits = map[string]float64{"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40, "p": 1 << 50}
+
+var sizeValue = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kmgtp]?)(?:i?b)?$`)
+
+// parseSize parses a size in bytes with an optional (binary) unit, such as 1.5G or 100KiB
+func parseSize(s string) (int64, int64, error) {
+	m := sizeValue.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, 0, ErrQuery
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, 0, ErrQuery
+	}
+	n *= sizeUnits[m[2]]
+	if n >= math.MaxInt64 {
+		return 0, 0, ErrQuery
+	}
+	return int64(n), int64(n) + 1, nil
+}
+
+var relValue = regexp.MustCompile(`^([0-9]+)([hdwy])$`)
+
+var relUnits = map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour}
+
+// parseDate parses a year, month (2006-01), day (2006-01-02), RFC3339 date, unix timestamp or
+// relative time (such as 7d for seven days ago) into the interval of seconds it denotes
+func parseDate(s string, now time.Time) (int64, int64, error) {
+	if m := relValue.FindStringSubmatch(s); m != nil {
+		n, err := strconv.ParseInt(m[1], 10, 32)
+		if err != nil {
+			return 0, 0, ErrQuery
+		}
+		t := now.Add(-time.Duration(n) * relUnits[m[2]]).Unix()
+		return t, t + 1, nil
+	}
+
+	for _, l := range []struct {
+		layout string
+		years  int
+		months int
+		days   int
+	}{
+		{"2006", 1, 0, 0},
+		{"2006-01", 0, 1, 0},
+		{"2006-01-02", 0, 0, 1},
+	} {
+		if t, err := time.Parse(l.layout, s); err == nil {
+			return t.Unix(), t.AddDate(l.years, l.months, l.days).Unix(), nil
+		}
+	}
+
+	t, err := parseTime(s)
+	if err != nil {
+		return 0, 0, ErrQuery
+	}
+	return t, t + 1, nil
+}
+
+// matchQuery reports whether live entry name (in directory root, at file on disk) matches q
+func matchQuery(q Query, root string, name string, dir bool, file string) bool {
+	if q == nil {
+		return true
+	}
+	return q.match(&queryEntry{name: name, dir: dir, root: root, file: file})
+}
+
+// Limits of regular expressions, bounding the time and memory it takes to compile them.
+// Matching takes time linear in the length of the input.
+const (
+	regexLength = 256
+	regexSize   = 4096
+)
+
+// expandedSize estimates the number of instructions re compiles to, with repetitions expanded
+func expandedSize(re *syntax.Regexp) int {
+	n := 1
+	for _, s := range re.Sub {
+		n += expandedSize(s)
+		if n > regexSize {
+			return n
+		}
+	}
+	if re.Op == syntax.OpRepeat {
+		m := re.Max
+		if m < re.Min {
+			m = re.Min
+		}
+		if m > 1 {
+			n *= m
+		}
+	}
+	return n
+}
+
+// compileRegex compiles regular expression s, refusing patterns that are too long or expand to a too large program
+func compileRegex(s string) (*regexp.Regexp, error) {
+	if len(s) > regexLength {
+		return nil, ErrQueryComplex
+	}
+
+	re, err := syntax.Parse(s, syntax.Perl)
+	if err != nil {
+		return nil, ErrQuery
+	}
+	if expandedSize(re) > regexSize {
+		return nil, ErrQueryComplex
+	}
+
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return nil, ErrQuery
+	}
+	if len(prog.Inst) > regexSize {
+		return nil, ErrQueryComplex
+	}
+
+	return regexp.Compile(s)
+}
+
+var (
+	regexMut   sync.Mutex
+	regexCache = map[string]*regexp.Regexp{}
+)
+
+// sqlRegexp implements the REGEXP operator of sqlite (x REGEXP y calls regexp(y, x))
+func sqlRegexp(pattern string, s string) (bool, error) {
+	regexMut.Lock()
+	re := regexCache[pattern]
+	if re == nil {
+		var err error
+		if re, err = compileRegex(pattern); err != nil {
+			regexMut.Unlock()
+			return false, err
+		}
+		if len(regexCache) >= 16 {
+			regexCache = map[string]*regexp.Regexp{}
+		}
+		regexCache[pattern] = re
+	}
+	regexMut.Unlock()
+
+	return re.MatchString(s), nil
+}
+
+type (
+	// Pattern (mode=glob), matched against the name or (if it contains a slash) the full path
+	queryGlob struct {
+		pattern string
+		re      *regexp.Regexp
+	}
+
+	// Regular expression (mode=regex), matched against the name or (if it contains a slash) the full path
+	queryRegex struct {
+		re *regexp.Regexp
+	}
+)
+
+// parseSearch parses search query s in mode (empty, fuzzy, glob or regex), returning nil for an empty query
+func parseSearch(s string, mode string) (Query, error) {
+	switch mode {
+	case "", "fuzzy":
+		return parseQuery(s)
+	default:
+		return parsePattern(s, mode)
+	}
+}
+
+// parsePattern parses search query s as a glob or regex pattern (depending on mode), returning nil for an empty pattern
+func parsePattern(s string, mode string) (Query, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	switch mode {
+	case "glob":
+		if len(s) > regexLength {
+			return nil, ErrQueryComplex
+		}
+		re, err := regexp.Compile(globRegex(s))
+		if err != nil {
+			return nil, ErrQuery
+		}
+		return &queryGlob{s, re}, nil
+	case "regex":
+		re, err := compileRegex(s)
+		if err != nil {
+			return nil, err
+		}
+		return &queryRegex{re}, nil
+	}
+
+	return nil, ErrQuery
+}
+
+// patternColumn is the column a pattern is matched against
+func patternColumn(p string) string {
+	if strings.Contains(p, "/") {
+		return "(dirs.path || files.name)"
+	}
+	return "files.name"
+}
+
+// globRegex translates a GLOB pattern of sqlite to a regular expression
+func globRegex(p string) string {
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			// Character class, where a leading ] is literal
+			j := i + 1
+			if j < len(p) && p[j] == '^' {
+				j++
+			}
+			if j < len(p) && p[j] == ']' {
+				j++
+			}
+			k := strings.IndexByte(p[j:], ']')
+			if k < 0 {
+				b.WriteString(regexp.QuoteMeta(p[i:]))
+				i = len(p)
+				break
+			}
+			class := p[i+1 : j+k]
+			neg := strings.HasPrefix(class, "^")
+			class = strings.TrimPrefix(class, "^")
+			b.WriteString("[")
+			if neg {
+				b.WriteString("^")
+			}
+			b.WriteString(strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(class))
+			b.WriteString("]")
+			i = j + k
+		default:
+			j := i
+			for j < len(p) && !strings.ContainsRune("*?[", rune(p[j])) {
+				j++
+			}
+			b.WriteString(regexp.QuoteMeta(p[i:j]))
+			i = j - 1
+		}
+	}
+	b.WriteString(")$")
+	return b.String()
+}
+
+func (q *queryGlob) where(c *queryCompiler) string {
+	c.arg(q.pattern)
+	return patternColumn(q.pattern) + " GLOB ?"
+}
+
+func (q *queryGlob) match(e *queryEntry) bool {
+	s := e.name
+	if strings.Contains(q.pattern, "/") {
+		s = e.root + e.name
+	}
+	return q.re.MatchString(s)
+}
+
+func (q *queryRegex) where(c *queryCompiler) string {
+	c.arg(q.re.String())
+	return patternColumn(q.re.String()) + " REGEXP ?"
+}
+
+func (q *queryRegex) match(e *queryEntry) bool {
+	s := e.name
+	if strings.Contains(q.re.String(), "/") {
+		s = e.root + e.name
+	}
+	return q.re.MatchString(s)
+}
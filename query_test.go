@@ -0,0 +1,93 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "Ubuntu-22.04-server.ISO")
+	if err := os.WriteFile(file, make([]byte, 2048), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2022, 4, 21, 12, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	for q, m := range map[string]bool{
+		"ubuntu server":                  true,
+		"ubu 22.04":                      true,
+		"buntu":                          true,
+		"ubuntu desktop":                 false,
+		"ubuntu -server":                 false,
+		"desktop OR server":              true,
+		"\"22.04-server\"":               true,
+		"\"22.04 server\"":               false,
+		"releases":                       true,
+		"-(desktop OR live) ext:iso,img": true,
+		"ext:img":                        false,
+		"type:f size:2K":                 true,
+		"size:>2k":                       false,
+		"size:1k..2k":                    true,
+		"mtime:2022-04":                  true,
+		"mtime:>=2022-04-22":             false,
+		"mtime:<2023 mtime:>2021":        true,
+		"path:/pub/releases/":            true,
+		"path:/releases/":                false,
+	} {
+		n, err := parseQuery(q)
+		if err != nil {
+			t.Fatalf("%s: %s\n", q, err.Error())
+		}
+		if matchQuery(n, "/pub/releases/", filepath.Base(file), false, file) != m {
+			t.Errorf("%s: expected match %v\n", q, m)
+		}
+	}
+
+	for _, q := range []string{"size:big", "mtime:yesterday", "type:x", "ext:,", "size:1..x"} {
+		if _, err := parseQuery(q); err == nil {
+			t.Errorf("%s: expected error\n", q)
+		}
+	}
+
+	if n, err := parseQuery("  "); n != nil || err != nil {
+		t.Errorf("Expected empty query, got %v (%v)\n", n, err)
+	}
+
+	for p, m := range map[string]bool{
+		"glob:*-server.ISO":          true,
+		"glob:*.iso":                 false,
+		"glob:[Uu]buntu-??.04-*":     true,
+		"glob:[^U]*":                 false,
+		"glob:/pub/*/Ubuntu*":        true,
+		"glob:a(b)+c":                false,
+		"regex:^ubuntu-[0-9.]+-":     false,
+		"regex:(?i)^ubuntu-[0-9.]+-": true,
+		"regex:releases/Ubuntu":      true,
+		"regex:\\.ISO$":              true,
+	} {
+		i := strings.IndexByte(p, ':')
+		n, err := parseSearch(p[i+1:], p[:i])
+		if err != nil {
+			t.Fatalf("%s: %s\n", p, err.Error())
+		}
+		if matchQuery(n, "/pub/releases/", filepath.Base(file), false, file) != m {
+			t.Errorf("%s: expected match %v\n", p, m)
+		}
+	}
+
+	for _, p := range []string{"(a{1000}){1000}", "((a{100}){100}){100}", strings.Repeat("a", 1000), "a(b"} {
+		if _, err := parseSearch(p, "regex"); err == nil {
+			t.Errorf("%s: expected error\n", p)
+		}
+	}
+}
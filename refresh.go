@@ -0,0 +1,575 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nielsAD/autoindex/sched"
+	"github.com/nielsAD/autoindex/walk"
+)
+
+// Errors
+var (
+	ErrNotReady  = errors.New("index not ready")
+	errTreeLimit = errors.New("too many entries")
+)
+
+// Maximum number of entries read from new subdirectories of a re-read directory,
+// larger subtrees are read when visited
+var newTreeLimit = 10000
+
+// FillPath refreshes the subtree at p, leaving the rest of the index untouched.
+// Returns the number of entries in the subtree.
+func (fs *CachedFS) FillPath(p string) (int, error) {
+	p = cleanPath(p)
+	if p == "/" {
+		return fs.Fill()
+	}
+
+	fs.lock(context.Background())
+	defer fs.unlock()
+
+	if !fs.DBReady() {
+		return 0, ErrNotReady
+	}
+	if err := fs.Available(); err != nil {
+		return 0, err
+	}
+
+	parent, name := path.Split(p[:len(p)-1])
+
+	var pid int64
+	if err := fs.db.QueryRow("SELECT rowid FROM dirs WHERE path = ?", parent).Scan(&pid); err == sql.ErrNoRows {
+		return 0, fmt.Errorf("parent directory of %s not indexed", p)
+	} else if err != nil {
+		return 0, err
+	}
+
+	glob := escapeGlob(p) + "*"
+
+	var old int64
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM files WHERE root IN (SELECT rowid FROM dirs WHERE path GLOB ?)", glob).Scan(&old); err != nil {
+		return 0, err
+	}
+
+	if err := fs.createTmp(); err != nil {
+		return 0, err
+	}
+
+	st, err := os.Stat(filepath.Join(fs.Root, filepath.FromSlash(p)))
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	exists := err == nil && !strings.HasPrefix(name, ".")
+
+	var s *scanner
+	if exists && st.IsDir() {
+		s, err = fs.scan(p, 0)
+	} else {
+		s = &scanner{db: fs.db}
+		err = s.begin()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Small subtrees may empty out, as long as the index as a whole does not shrink too much
+	tx := s.tx
+	dbn := atomic.LoadInt64(&fs.dbn)
+	err = fs.checkShrink(dbn, dbn-old+int64(s.cnt))
+	if err == nil {
+		// Backing store may have disappeared while walking
+		err = fs.Available()
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	track := fs.Retention > 0
+	scope := "dirs.path GLOB ? OR (dirs.path = ? AND files.name = ?)"
+	if track {
+		if err := snapshot(tx, "diff_old", scope, glob, parent, name); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	type stmt struct {
+		q    string
+		args []interface{}
+	}
+
+	stmts := []stmt{
+		{"DELETE FROM files WHERE root IN (SELECT rowid FROM dirs WHERE path GLOB ?)", []interface{}{glob}},
+		{"DELETE FROM dirs WHERE path GLOB ?", []interface{}{glob}},
+		{"INSERT INTO dirs (path, search, scanned) SELECT path, search, scanned FROM dirs_tmp ORDER BY rowid", nil},
+		{"INSERT INTO files (root, name, search, dir, size, mtime) SELECT dirs.rowid, files_tmp.name, files_tmp.search, files_tmp.dir, files_tmp.size, files_tmp.mtime FROM files_tmp JOIN dirs_tmp ON files_tmp.root = dirs_tmp.rowid JOIN dirs ON dirs.path = dirs_tmp.path", nil},
+		{"DELETE FROM files WHERE root = ? AND name = ?", []interface{}{pid, name}},
+	}
+	if exists {
+		stmts = append(stmts, stmt{"INSERT INTO files (root, name, search, dir, size, mtime) VALUES (?, ?, ?, ?, ?, ?)", []interface{}{pid, name, fold(name), st.IsDir(), st.Size(), st.ModTime().Unix()}})
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt.q, stmt.args...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := indexTokens(tx, scope, glob, parent, name); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := fs.indexContent(tx, false, scope, glob, parent, name); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := aggregate(tx, p, true); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	gen, err := fs.record(tx, p, track, scope, glob, parent, name)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&fs.dbn, int64(s.cnt)-old)
+	fs.publish(gen, false)
+
+	return s.cnt, nil
+}
+
+// Refresh policy for a subtree
+type policy struct {
+	Path     string
+	Spec     string
+	Schedule sched.Schedule
+}
+
+// Policies list (flag.Value)
+type policies []policy
+
+func (p *policies) String() string {
+	var s []string
+	for _, v := range *p {
+		s = append(s, v.Path+"="+v.Spec)
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *policies) Set(s string) error {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return errors.New("expected path=schedule")
+	}
+
+	spec := s[i+1:]
+	sch, err := sched.Parse(spec)
+	if err != nil {
+		return err
+	}
+	if sch == nil {
+		return errors.New("empty schedule")
+	}
+
+	*p = append(*p, policy{Path: cleanPath(s[:i]), Spec: spec, Schedule: sch})
+	return nil
+}
+
+// tree holds the directories (root first) and entries of a subtree read by readTree
+type tree struct {
+	dirs []string
+	ents []treeEntry
+}
+
+type treeEntry struct {
+	root  string
+	name  string
+	dir   bool
+	size  int64
+	mtime int64
+}
+
+// readTree reads the subtree at sub like scan does, but into memory.
+// Gives up with errTreeLimit after limit entries.
+func (fs *CachedFS) readTree(sub string, limit int) (*tree, error) {
+	var t tree
+	var stack []string
+
+	skip := true
+	trim := len(fs.Root)
+	if strings.HasSuffix(fs.Root, string(filepath.Separator)) {
+		trim--
+	}
+
+	err := walk.Walk(filepath.Join(fs.Root, filepath.FromSlash(sub)), &walk.Options{
+		Error: func(r string, e *walk.Dirent, err error) error {
+			if err == errTreeLimit {
+				return err
+			}
+			logErr.Printf("Error iterating \"%s\": %s\n", r, err.Error())
+			return nil
+		},
+		Visit: func(r string, e *walk.Dirent) error {
+			// Skip root
+			if skip {
+				skip = false
+				return nil
+			}
+
+			n := e.Name()
+			if n == "" || strings.HasPrefix(n, ".") {
+				return nil
+			}
+			if len(t.ents) >= limit {
+				return errTreeLimit
+			}
+
+			size, mtime := stat(r)
+			t.ents = append(t.ents, treeEntry{root: stack[len(stack)-1], name: n, dir: e.IsDir(), size: size, mtime: mtime})
+			return nil
+		},
+		Enter: func(r string, e *walk.Dirent) error {
+			if strings.HasPrefix(e.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			if e.IsSymlink() {
+				in, err := fs.insideRoot(r)
+				if err != nil {
+					return err
+				}
+				if in {
+					logErr.Printf("Skipping symlink relative to root (%s)\n", r)
+					return filepath.SkipDir
+				}
+			}
+
+			dir := filepath.ToSlash(r[trim:]) + "/"
+			t.dirs = append(t.dirs, dir)
+			stack = append(stack, dir)
+			return nil
+		},
+		Leave: func(r string, e *walk.Dirent, err error) error {
+			stack = stack[:len(stack)-1]
+			return err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// FillDir re-reads the entries of a single cached directory at p, reading new
+// subdirectories (up to newTreeLimit entries in total) and dropping removed ones.
+// Returns the number of entries in the directory.
+func (fs *CachedFS) FillDir(ctx context.Context, p string) (int, error) {
+	p = cleanPath(p)
+	if err := fs.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer fs.unlock()
+
+	if !fs.DBReady() {
+		return 0, ErrNotReady
+	}
+	if err := fs.available(); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	if err := fs.db.QueryRowContext(ctx, "SELECT rowid FROM dirs WHERE path = ?", p).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	type entry struct {
+		name  string
+		dir   bool
+		link  bool
+		size  int64
+		mtime int64
+	}
+
+	var ents []entry
+	depth := 0
+	err := walk.Walk(filepath.Join(fs.Root, filepath.FromSlash(p)), &walk.Options{
+		Error: func(r string, e *walk.Dirent, err error) error {
+			logErr.Printf("Error iterating \"%s\": %s\n", r, err.Error())
+			return nil
+		},
+		Visit: func(r string, e *walk.Dirent) error {
+			if depth == 0 {
+				return nil
+			}
+
+			n := e.Name()
+			if n == "" || strings.HasPrefix(n, ".") {
+				return nil
+			}
+
+			size, mtime := stat(r)
+			ents = append(ents, entry{name: n, dir: e.IsDir(), link: e.IsSymlink(), size: size, mtime: mtime})
+			return nil
+		},
+		Enter: func(r string, e *walk.Dirent) error {
+			if depth >= 1 {
+				return filepath.SkipDir
+			}
+			depth++
+			return nil
+		},
+		Leave: func(r string, e *walk.Dirent, err error) error {
+			depth--
+			return err
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	glob := escapeGlob(p)
+	rows, err := fs.db.QueryContext(ctx, "SELECT path FROM dirs WHERE path GLOB ? AND path NOT GLOB ?", glob+"?*/", glob+"?*/?*")
+	if err != nil {
+		return 0, err
+	}
+
+	old := map[string]bool{}
+	for rows.Next() {
+		var sub string
+		if err := rows.Scan(&sub); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		old[sub] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// Subdirectories with a cached entry in the index
+	cur := map[string]bool{}
+	for _, e := range ents {
+		if !e.dir {
+			continue
+		}
+
+		sub := p + e.name + "/"
+		if e.link {
+			in, err := fs.insideRoot(filepath.Join(fs.Root, filepath.FromSlash(sub)))
+			if err != nil || in {
+				continue
+			}
+		}
+		cur[sub] = true
+	}
+
+	// Read new subdirectories now, so that they are searchable and counted in the aggregates.
+	// Those that do not fit in the limit (nil) are left for their first visit.
+	trees := map[string]*tree{}
+	limit := newTreeLimit
+	for sub := range cur {
+		if old[sub] {
+			continue
+		}
+
+		t, err := fs.readTree(sub, limit)
+		if err == errTreeLimit {
+			t = nil
+		} else if err != nil {
+			return 0, err
+		} else {
+			limit -= len(t.ents)
+		}
+		trees[sub] = t
+	}
+
+	scope := "dirs.path = ?"
+	args := []interface{}{p}
+	for sub := range old {
+		if !cur[sub] {
+			scope += " OR dirs.path GLOB ?"
+			args = append(args, escapeGlob(sub)+"*")
+		}
+	}
+	for sub := range trees {
+		scope += " OR dirs.path GLOB ?"
+		args = append(args, escapeGlob(sub)+"*")
+	}
+
+	tx, err := fs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	track := fs.Retention > 0
+	if track {
+		if err := snapshot(tx, "diff_old", scope, args...); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	exec := func(q string, args ...interface{}) (sql.Result, error) {
+		return tx.ExecContext(ctx, q, args...)
+	}
+
+	res, err := exec("DELETE FROM files WHERE root = ?", id)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	del, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for _, e := range ents {
+		if _, err := exec("INSERT INTO files (root, name, search, dir, size, mtime) VALUES (?, ?, ?, ?, ?, ?)", id, e.name, fold(e.name), e.dir, e.size, e.mtime); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	now := time.Now().Unix()
+	add := int64(len(ents))
+	for sub, t := range trees {
+		// Unread subdirectories are marked by scanned = 0
+		scanned := now
+		if t == nil {
+			t = &tree{dirs: []string{sub}}
+			scanned = 0
+		}
+
+		ids := map[string]int64{}
+		for _, d := range t.dirs {
+			res, err := exec("INSERT INTO dirs (path, search, scanned) VALUES (?, ?, ?)", d, fold(d), scanned)
+			if err == nil {
+				ids[d], err = res.LastInsertId()
+			}
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+
+		for _, e := range t.ents {
+			if _, err := exec("INSERT INTO files (root, name, search, dir, size, mtime) VALUES (?, ?, ?, ?, ?, ?)", ids[e.root], e.name, fold(e.name), e.dir, e.size, e.mtime); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+		add += int64(len(t.ents))
+	}
+
+	for sub := range old {
+		if cur[sub] {
+			continue
+		}
+
+		glob := escapeGlob(sub) + "*"
+		res, err := exec("DELETE FROM files WHERE root IN (SELECT rowid FROM dirs WHERE path GLOB ?)", glob)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		del += n
+
+		if _, err := exec("DELETE FROM dirs WHERE path GLOB ?", glob); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if _, err := exec("UPDATE dirs SET scanned = ? WHERE rowid = ?", now, id); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := indexTokens(tx, scope, args...); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := fs.indexContent(tx, false, scope, args...); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	for sub := range trees {
+		if err := rollup(tx, sub); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := aggregate(tx, p, false); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	gen, err := fs.record(tx, p, track, scope, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	atomic.AddInt64(&fs.dbn, add-del)
+	fs.publish(gen, true)
+
+	return len(ents), nil
+}
+
+// visit refreshes a stale directory at p, either asynchronously or within the deadline of ctx
+func (fs *CachedFS) visit(ctx context.Context, p string) {
+	refresh := func(ctx context.Context) {
+		if _, busy := fs.pending.LoadOrStore(p, true); busy {
+			return
+		}
+		defer fs.pending.Delete(p)
+
+		if _, err := fs.FillDir(ctx, p); err != nil && ctx.Err() == nil {
+			logErr.Printf("FillDir(%s): %s\n", p, err.Error())
+		}
+	}
+
+	if fs.StaleAsync {
+		go refresh(context.Background())
+	} else {
+		refresh(ctx)
+	}
+}
@@ -0,0 +1,247 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFillPath(t *testing.T) {
+	fs, root := newTestFS(t, "a/1.txt", "a/2.txt", "a/3.txt", "a/sub/z.txt", "b/y.txt")
+	fs.Retention = time.Hour
+	fill(t, fs)
+
+	indexed := func(p string) bool {
+		t.Helper()
+		dir, name := filepath.Split(p)
+		var n int
+		if err := fs.db.QueryRow("SELECT COUNT(*) FROM files JOIN dirs ON files.root = dirs.rowid WHERE dirs.path = ? AND files.name = ?", dir, name).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n > 0
+	}
+
+	// Sibling subtrees are left untouched
+	writeFiles(t, root, "a/new.txt", "b/new.txt")
+	if n, err := fs.FillPath("/a/"); err != nil || n != 6 {
+		t.Fatalf("Expected 6 entries, got %d (%v)\n", n, err)
+	}
+	if !indexed("/a/new.txt") || indexed("/b/new.txt") || !indexed("/b/y.txt") {
+		t.Fatal("Expected only /a/ to be refreshed")
+	}
+	var roots []string
+	rows, err := fs.db.Query("SELECT DISTINCT root FROM changes WHERE gen = ?", fs.Generation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var r string
+		rows.Scan(&r)
+		roots = append(roots, r)
+	}
+	rows.Close()
+	if len(roots) != 1 || roots[0] != "/a/" {
+		t.Fatalf("Expected changes in /a/ only, got %v\n", roots)
+	}
+
+	// Refreshes that shrink the index too much are refused (4 of 10 entries)
+	fs.MaxShrink = 0.3
+	gen := fs.Generation()
+	for _, name := range []string{"a/1.txt", "a/2.txt", "a/3.txt", "a/new.txt"} {
+		if err := os.Remove(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.FillPath("/a/"); err == nil {
+		t.Fatal("Expected shrinking refresh to be refused")
+	}
+	if !indexed("/a/1.txt") || fs.Generation() != gen {
+		t.Fatal("Expected subtree to be kept")
+	}
+
+	// Emptying a small subtree is not
+	writeFiles(t, root, "a/1.txt", "a/2.txt", "a/3.txt")
+	if err := os.Remove(filepath.Join(root, "a", "sub", "z.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fs.FillPath("/a/sub/"); err != nil || n != 0 || indexed("/a/sub/z.txt") {
+		t.Fatalf("Expected empty subtree, got %d (%v)\n", n, err)
+	}
+
+	// Removing the subtree itself
+	fs.MaxShrink = 0
+	if err := os.RemoveAll(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := fs.FillPath("/a/"); err != nil || n != 0 {
+		t.Fatalf("Expected empty subtree, got %d (%v)\n", n, err)
+	}
+	if indexed("/a") || indexed("/a/sub/z.txt") || !indexed("/b/y.txt") {
+		t.Fatal("Expected /a/ to be removed from the index")
+	}
+	var dirs int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM dirs WHERE path GLOB '/a/*'").Scan(&dirs); err != nil || dirs != 0 {
+		t.Fatalf("Expected directories of /a/ to be dropped, got %d (%v)\n", dirs, err)
+	}
+	var op string
+	if err := fs.db.QueryRow("SELECT op FROM changes WHERE gen = ? AND root = '/' AND name = 'a'", fs.Generation()).Scan(&op); err != nil || op != "removed" {
+		t.Fatalf("Expected removal of /a to be logged, got %q (%v)\n", op, err)
+	}
+
+	if _, err := fs.FillPath("/missing/sub/"); err == nil {
+		t.Fatal("Expected error for subtree without indexed parent")
+	}
+}
+
+func TestFillDir(t *testing.T) {
+	fs, root := newTestFS(t, "d/x.txt", "d/old/o.txt", "d/keep/k.txt", "d/big/")
+	fs.Retention = time.Hour
+	fill(t, fs)
+
+	var published, changed int
+	fs.OnPublish(func(gen int64) { published++ })
+	fs.OnChange(func(gen int64) { changed++ })
+
+	// Added, removed and renamed subdirectories
+	writeFiles(t, root, "d/new/n.txt", "d/new/deep/z.txt", "d/empty/")
+	if err := os.RemoveAll(filepath.Join(root, "d", "old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(root, "d", "keep"), filepath.Join(root, "d", "moved")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := fs.FillDir(context.Background(), "/d/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Fatalf("Expected 5 entries, got %d\n", n)
+	}
+
+	scanned := func(p string) (int64, bool) {
+		t.Helper()
+		var ts int64
+		if err := fs.db.QueryRow("SELECT scanned FROM dirs WHERE path = ?", p).Scan(&ts); err != nil {
+			return 0, false
+		}
+		return ts, true
+	}
+	for _, p := range []string{"/d/new/", "/d/new/deep/", "/d/moved/", "/d/empty/", "/d/big/"} {
+		if ts, ok := scanned(p); !ok || ts == 0 {
+			t.Errorf("Expected %s to be read, got %d (%t)\n", p, ts, ok)
+		}
+	}
+	for _, p := range []string{"/d/old/", "/d/keep/"} {
+		if _, ok := scanned(p); ok {
+			t.Errorf("Expected %s to be dropped\n", p)
+		}
+	}
+
+	// Contents of new subdirectories are searchable and counted
+	q, err := parseQuery("z.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := fs.search(context.Background(), "/d/*", 3, q, false); err != nil || len(res) != 1 || res[0].Name != "new/deep/z.txt" {
+		t.Errorf("Expected new file to be found, got %+v (%v)\n", res, err)
+	}
+	a, err := scanAggregate(fs.db.QueryRow("SELECT "+aggCols+" FROM dirs WHERE path = ?", "/d/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Files != 4 || a.Dirs != 5 || a.Partial {
+		t.Errorf("Unexpected aggregate %+v\n", a)
+	}
+
+	var added, removed int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FILTER (WHERE op = 'added'), COUNT(*) FILTER (WHERE op = 'removed') FROM changes WHERE gen = ?", fs.Generation()).Scan(&added, &removed); err != nil {
+		t.Fatal(err)
+	}
+	if added != 7 || removed != 4 {
+		t.Errorf("Expected 7 added and 4 removed entries, got %d and %d\n", added, removed)
+	}
+
+	// Only per-change listeners are notified of single directories
+	if published != 0 || changed != 1 {
+		t.Errorf("Unexpected notifications (publish %d, change %d)\n", published, changed)
+	}
+
+	// Nothing changed, nothing published
+	gen := fs.Generation()
+	if _, err := fs.FillDir(context.Background(), "/d/"); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Generation() != gen || changed != 1 {
+		t.Errorf("Expected no new generation, got %d (%d notifications)\n", fs.Generation(), changed)
+	}
+
+	// Subtrees beyond the limit are left for their first visit
+	defer func(n int) { newTreeLimit = n }(newTreeLimit)
+	newTreeLimit = 1
+	writeFiles(t, root, "d/huge/a.txt", "d/huge/b.txt")
+	if _, err := fs.FillDir(context.Background(), "/d/"); err != nil {
+		t.Fatal(err)
+	}
+	if ts, ok := scanned("/d/huge/"); !ok || ts != 0 {
+		t.Errorf("Expected unread /d/huge/, got %d (%t)\n", ts, ok)
+	}
+	for _, p := range []string{"/d/huge/", "/d/", "/"} {
+		a, err := scanAggregate(fs.db.QueryRow("SELECT "+aggCols+" FROM dirs WHERE path = ?", p))
+		if err != nil || !a.Partial {
+			t.Errorf("%s: Expected partial aggregate, got %+v (%v)\n", p, a, err)
+		}
+	}
+
+	if _, err := fs.FillDir(context.Background(), "/d/huge/"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/d/huge/", "/d/", "/"} {
+		a, err := scanAggregate(fs.db.QueryRow("SELECT "+aggCols+" FROM dirs WHERE path = ?", p))
+		if err != nil || a.Partial {
+			t.Errorf("%s: Expected complete aggregate, got %+v (%v)\n", p, a, err)
+		}
+	}
+}
+
+func TestVisit(t *testing.T) {
+	fs, root := newTestFS(t, "d/")
+	fs.Retention = time.Hour
+	fs.StaleAsync = true
+	fill(t, fs)
+	writeFiles(t, root, "d/a.txt")
+	gen := fs.Generation()
+
+	// A refresh of the same directory is already running
+	fs.pending.Store("/d/", true)
+	fs.visit(context.Background(), "/d/")
+	time.Sleep(100 * time.Millisecond)
+	if fs.Generation() != gen {
+		t.Fatal("Expected visit to be skipped")
+	}
+	if _, ok := fs.pending.Load("/d/"); !ok {
+		t.Fatal("Expected running refresh to stay registered")
+	}
+	fs.pending.Delete("/d/")
+
+	fs.visit(context.Background(), "/d/")
+	for deadline := time.Now().Add(5 * time.Second); fs.Generation() == gen; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected asynchronous refresh")
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, ok := fs.pending.Load("/d/"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected refresh to be unregistered")
+		}
+	}
+}
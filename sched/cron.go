@@ -0,0 +1,197 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package sched
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Errors
+var (
+	ErrCronFields = errors.New("sched: Expected 5 fields (minute, hour, day of month, month, day of week)")
+)
+
+// Cron schedule (standard five-field notation)
+type Cron struct {
+	min   uint64
+	hour  uint64
+	dom   uint64
+	month uint64
+	dow   uint64
+
+	// Day of month/week restricted (i.e. not *)
+	domr bool
+	dowr bool
+}
+
+type field struct {
+	min   int
+	max   int
+	names []string
+}
+
+var (
+	fMin   = field{min: 0, max: 59}
+	fHour  = field{min: 0, max: 23}
+	fDom   = field{min: 1, max: 31}
+	fMonth = field{min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	fDow   = field{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+var descriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a cron expression, such as "30 4 * * 1-5" or "@daily".
+func ParseCron(s string) (*Cron, error) {
+	s = strings.TrimSpace(s)
+	if d, ok := descriptors[strings.ToLower(s)]; ok {
+		s = d
+	}
+
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, ErrCronFields
+	}
+
+	var c Cron
+	var err error
+	if c.min, err = parseField(f[0], fMin); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(f[1], fHour); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(f[2], fDom); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(f[3], fMonth); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(f[4], fDow); err != nil {
+		return nil, err
+	}
+
+	// Sunday is both 0 and 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domr = f[2] != "*" && f[2] != "?"
+	c.dowr = f[4] != "*" && f[4] != "?"
+	return &c, nil
+}
+
+func parseValue(s string, f field) (int, error) {
+	for i, n := range f.names {
+		if n != "" && strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("sched: Invalid value %q", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, fmt.Errorf("sched: Value %d out of range [%d, %d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+func parseField(s string, f field) (uint64, error) {
+	var res uint64
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.IndexByte(item, '/'); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("sched: Invalid step %q", item[i+1:])
+			}
+			step = n
+			item = item[:i]
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case item == "*" || item == "?":
+		case strings.IndexByte(item, '-') > 0:
+			i := strings.IndexByte(item, '-')
+			var err error
+			if lo, err = parseValue(item[:i], f); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(item[i+1:], f); err != nil {
+				return 0, err
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("sched: Invalid range %q", item)
+			}
+		default:
+			v, err := parseValue(item, f)
+			if err != nil {
+				return 0, err
+			}
+			lo = v
+			if step == 1 {
+				hi = v
+			}
+		}
+
+		for v := lo; v <= hi; v += step {
+			res |= 1 << uint(v)
+		}
+	}
+
+	return res, nil
+}
+
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domr && c.dowr {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first activation time after t
+func (c *Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Give up if there is no match within a few years (e.g. February 30th)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.min&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
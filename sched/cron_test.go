@@ -0,0 +1,82 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package sched_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nielsAD/autoindex/sched"
+)
+
+func TestCron(t *testing.T) {
+	var tests = []struct {
+		expr string
+		from string
+		next string
+	}{
+		{"* * * * *", "2022-06-12 10:30:15", "2022-06-12 10:31:00"},
+		{"30 4 * * *", "2022-06-12 10:30:00", "2022-06-13 04:30:00"},
+		{"*/15 * * * *", "2022-06-12 10:31:00", "2022-06-12 10:45:00"},
+		{"0 0 1 * *", "2022-06-12 10:30:00", "2022-07-01 00:00:00"},
+		{"0 12 * * mon-fri", "2022-06-11 13:00:00", "2022-06-13 12:00:00"},
+		{"0 0 * * 7", "2022-06-12 10:30:00", "2022-06-19 00:00:00"},
+		{"0 0 13 * fri", "2022-06-12 10:30:00", "2022-06-13 00:00:00"},
+		{"0 0 29 feb *", "2022-06-12 10:30:00", "2024-02-29 00:00:00"},
+		{"5,10-12 3 * dec *", "2022-06-12 10:30:00", "2022-12-01 03:05:00"},
+		{"@hourly", "2022-06-12 10:30:00", "2022-06-12 11:00:00"},
+		{"@weekly", "2022-06-12 10:30:00", "2022-06-19 00:00:00"},
+	}
+
+	const layout = "2006-01-02 15:04:05"
+	for _, tc := range tests {
+		c, err := sched.ParseCron(tc.expr)
+		if err != nil {
+			t.Errorf("Error parsing `%s`: %s\n", tc.expr, err.Error())
+			continue
+		}
+
+		from, _ := time.Parse(layout, tc.from)
+		if next := c.Next(from).Format(layout); next != tc.next {
+			t.Errorf("Unexpected activation for `%s` after %s: %s (expected %s)\n", tc.expr, tc.from, next, tc.next)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		if _, err := sched.ParseCron(expr); err == nil {
+			t.Errorf("Expected error parsing `%s`\n", expr)
+		}
+	}
+
+	c, _ := sched.ParseCron("0 0 30 feb *")
+	if n := c.Next(time.Now()); !n.IsZero() {
+		t.Errorf("Unexpected activation for impossible date: %s\n", n)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var err error = errors.New("fail")
+	s := sched.Scheduler{
+		Job:        func() error { return err },
+		Schedule:   sched.Every(time.Hour),
+		Backoff:    time.Minute,
+		MaxBackoff: 3 * time.Minute,
+	}
+
+	now := time.Now()
+	for _, d := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		s.Do()
+		if n := s.Next(now).Sub(now); n != d {
+			t.Errorf("Unexpected backoff: %s (expected %s)\n", n, d)
+		}
+	}
+
+	err = nil
+	s.Do()
+	if n := s.Next(now).Sub(now); n != time.Hour {
+		t.Errorf("Unexpected interval: %s (expected %s)\n", n, time.Hour)
+	}
+}
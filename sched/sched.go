@@ -0,0 +1,140 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+// Package sched runs periodic jobs on a fixed interval or cron schedule.
+package sched
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Errors
+var (
+	ErrRunning = errors.New("sched: Job is already running")
+)
+
+// Schedule describes when a job is activated
+type Schedule interface {
+	// Next returns the first activation time after t (zero if none)
+	Next(t time.Time) time.Time
+}
+
+// Every activates on a fixed interval
+type Every time.Duration
+
+// Next returns t + interval
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// Parse a schedule description, being a duration ("1h30m"), "@every <duration>",
+// a descriptor ("@daily") or a cron expression ("30 4 * * *").
+// Returns nil for an empty or zero schedule.
+func Parse(s string) (Schedule, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "@every ") {
+		s = strings.TrimSpace(s[len("@every "):])
+	}
+	if s == "" {
+		return nil, nil
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return nil, errors.New("sched: Negative interval")
+		}
+		if d == 0 {
+			return nil, nil
+		}
+		return Every(d), nil
+	}
+
+	c, err := ParseCron(s)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Scheduler runs a job according to its schedule
+type Scheduler struct {
+	Job      func() error
+	Schedule Schedule
+
+	// Random delay added to every activation
+	Jitter time.Duration
+
+	// Delay before retrying a failed job, doubled after every consecutive failure
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	running int32
+	fails   int32
+}
+
+// Do runs the job now, unless it is already running (ErrRunning)
+func (s *Scheduler) Do() error {
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
+		return ErrRunning
+	}
+	defer atomic.StoreInt32(&s.running, 0)
+
+	err := s.Job()
+	if err != nil {
+		atomic.AddInt32(&s.fails, 1)
+	} else {
+		atomic.StoreInt32(&s.fails, 0)
+	}
+	return err
+}
+
+// Next returns the next activation time after t (zero if none)
+func (s *Scheduler) Next(t time.Time) time.Time {
+	var next time.Time
+	if f := atomic.LoadInt32(&s.fails); f > 0 && s.Backoff > 0 {
+		b := s.Backoff
+		for i := int32(1); i < f && (s.MaxBackoff <= 0 || b < s.MaxBackoff); i++ {
+			b *= 2
+		}
+		if s.MaxBackoff > 0 && b > s.MaxBackoff {
+			b = s.MaxBackoff
+		}
+		next = t.Add(b)
+	} else if s.Schedule != nil {
+		next = s.Schedule.Next(t)
+	}
+
+	if !next.IsZero() && s.Jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.Jitter))))
+	}
+	return next
+}
+
+// Run the job on schedule until ctx is done or there are no more activations.
+// Errors are passed to the (optional) error handler.
+func (s *Scheduler) Run(ctx context.Context, handler func(error)) {
+	for {
+		next := s.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+
+		t := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		if err := s.Do(); err != nil && handler != nil {
+			handler(err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Maximum number of candidates that are ranked for a search
+const searchCandidates = 10000
+
+// Maximum number of search results
+const searchResults = 1000
+
+type token struct {
+	text  string
+	start int
+	end   int
+}
+
+// tokenize splits s into runs of letters and digits (and their combining marks), with their
+// byte offsets in s and their text normalized by fold
+func tokenize(s string) []token {
+	var res []token
+	scanTokens(s, func(t token) bool {
+		res = append(res, t)
+		return true
+	})
+	return res
+}
+
+// scanTokens calls f for every token of s (see tokenize), until it returns false
+func scanTokens(s string, f func(t token) bool) {
+	start := -1
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || (start >= 0 && unicode.IsMark(r)) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			if !f(token{text: fold(s[start:i]), start: start, end: i}) {
+				return
+			}
+			start = -1
+		}
+	}
+	if start >= 0 {
+		f(token{text: fold(s[start:]), start: start, end: len(s)})
+	}
+}
+
+// trigrams returns the trigrams of word, padded to include its start and end
+func trigrams(word string) []string {
+	r := []rune("  " + word + " ")
+	res := make([]string, 0, len(r)-2)
+	seen := map[string]bool{}
+	for i := 0; i+3 <= len(r); i++ {
+		g := string(r[i : i+3])
+		if !seen[g] {
+			seen[g] = true
+			res = append(res, g)
+		}
+	}
+	return res
+}
+
+// indexTokens adds the name tokens of the files matching where (with dirs joined) to the token
+// index, and any new words to the trigram index
+func indexTokens(tx *sql.Tx, where string, args ...interface{}) error {
+	ins, err := tx.Prepare("INSERT INTO tokens (token, file) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer ins.Close()
+
+	iword, err := tx.Prepare("INSERT OR IGNORE INTO words (word) VALUES (?)")
+	if err != nil {
+		return err
+	}
+	defer iword.Close()
+
+	igram, err := tx.Prepare("INSERT INTO trigrams (gram, word) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer igram.Close()
+
+	type entry struct {
+		id   int64
+		name string
+	}
+
+	// Read in batches, rather than inserting while the query is running
+	var last int64
+	for {
+		rows, err := tx.Query("SELECT files.rowid, files.name FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.rowid > ? AND ("+where+") ORDER BY files.rowid LIMIT 16384", append([]interface{}{last}, args...)...)
+		if err != nil {
+			return err
+		}
+
+		var batch []entry
+		for rows.Next() {
+			var e entry
+			if err := rows.Scan(&e.id, &e.name); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for _, e := range batch {
+			seen := map[string]bool{}
+			for _, t := range tokenize(e.name) {
+				if seen[t.text] {
+					continue
+				}
+				seen[t.text] = true
+				if _, err := ins.Exec(t.text, e.id); err != nil {
+					return err
+				}
+
+				res, err := iword.Exec(t.text)
+				if err != nil {
+					return err
+				}
+				if n, err := res.RowsAffected(); err != nil {
+					return err
+				} else if n == 0 {
+					continue
+				}
+				for _, g := range trigrams(t.text) {
+					if _, err := igram.Exec(g, t.text); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		last = batch[len(batch)-1].id
+	}
+}
+
+// distance returns the edit distance between a and b, counting insertions, deletions,
+// substitutions and transpositions of adjacent characters
+func distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	min := func(a, b int) int {
+		if a < b {
+			return a
+		}
+		return b
+	}
+
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(min(d[i-1][j]+1, d[i][j-1]+1), d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// maxDistance is the edit distance allowed for a word of n characters
+func maxDistance(n int) int {
+	switch {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Maximum number of similar words considered per search term
+const similarWords = 32
+
+// similar returns the indexed words within the edit distance threshold of word, with their
+// similarity (1 for an exact match), most similar first
+func (fs *CachedFS) similar(ctx context.Context, word string) (map[string]float64, []string, error) {
+	n := utf8.RuneCountInString(word)
+	max := maxDistance(n)
+
+	grams := trigrams(word)
+	shared := len(grams) - 3*max
+	if shared < 1 {
+		shared = 1
+	}
+
+	args := []interface{}{}
+	for _, g := range grams {
+		args = append(args, g)
+	}
+	args = append(args, shared)
+
+	rows, err := fs.db.QueryContext(ctx, "SELECT word FROM trigrams WHERE gram IN (?"+strings.Repeat(", ?", len(grams)-1)+") GROUP BY word HAVING COUNT(*) >= ? ORDER BY COUNT(*) DESC LIMIT 1000", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	sim := map[string]float64{}
+	var words []string
+	for rows.Next() {
+		var w string
+		if err := rows.Scan(&w); err != nil {
+			return nil, nil, err
+		}
+
+		m := utf8.RuneCountInString(w)
+		if m-n > max || n-m > max {
+			continue
+		}
+		d := distance(word, w)
+		if d > max {
+			continue
+		}
+		if m < n {
+			m = n
+		}
+		sim[w] = 1 - float64(d)/float64(m)
+		words = append(words, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	sort.SliceStable(words, func(i, j int) bool { return sim[words[i]] > sim[words[j]] })
+	if len(words) > similarWords {
+		for _, w := range words[similarWords:] {
+			delete(sim, w)
+		}
+		words = words[:similarWords]
+	}
+	return sim, words, nil
+}
+
+// utf16Len returns the length of s in UTF-16 code units (JavaScript string length)
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// term of a search query
+type term struct {
+	text string
+
+	// Byte offset in the query
+	pos int
+
+	// Match text as a substring, rather than a token
+	phrase bool
+
+	// Words accepted in place of text, by similarity (nil for an exact or prefix match)
+	words map[string]float64
+}
+
+// where compiles the match of term t to the tokens of a name to SQL
+func (t *term) where(c *queryCompiler) string {
+	switch {
+	case t.phrase:
+		c.arg(likeContains(t.text))
+		return "files.search LIKE ? ESCAPE '`'"
+	case t.words != nil:
+		if len(t.words) == 0 {
+			return "0"
+		}
+		for w := range t.words {
+			c.arg(w)
+		}
+		return "files.rowid IN (SELECT file FROM tokens WHERE token IN (?" + strings.Repeat(", ?", len(t.words)-1) + "))"
+	default:
+		c.arg(escapeGlob(t.text) + "*")
+		return "files.rowid IN (SELECT file FROM tokens WHERE token GLOB ?)"
+	}
+}
+
+// matches reports whether term t matches one of the tokens of a name (or, for phrases, the folded name)
+func (t *term) matches(tokens []token, name string) bool {
+	if t.phrase {
+		return strings.Contains(name, t.text)
+	}
+	for i := range tokens {
+		if w, _ := t.weigh(&tokens[i]); w > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// weigh the match of term t to token k, returning its weight and whether it matched the whole token (or a prefix)
+func (t *term) weigh(k *token) (float64, bool) {
+	if t.words != nil {
+		return 3 * t.words[k.text], true
+	}
+	if k.text == t.text {
+		return 3, true
+	}
+	if strings.HasPrefix(k.text, t.text) {
+		return 2, false
+	}
+	return 0, false
+}
+
+// rank scores name (a path relative to the searched directory) against the query terms.
+// Matches in the base name weigh more than matches in the path, exact tokens more than
+// prefixes (or similar words) and prefixes more than substrings. Terms that match consecutive
+// tokens earn a bonus. Returns the score and the matched ranges of name, in UTF-16 code units.
+func rank(name string, terms []term) (float64, [][2]int) {
+	base := strings.LastIndexByte(strings.TrimSuffix(name, "/"), '/') + 1
+	tokens := tokenize(name)
+
+	var spans [][2]int
+	folded := foldSpans(name, &spans)
+
+	var score float64
+	var ranges [][2]int
+	prev := -2
+	for _, term := range terms {
+		best, at, start, end := 0.0, -1, 0, 0
+		for i := range tokens {
+			k := &tokens[i]
+			w, whole := term.weigh(k)
+			if k.start < base {
+				w /= 4
+			}
+			if w > best {
+				best, at, start, end = w, i, k.start, k.end
+				if !whole {
+					end = k.start + foldPrefix(name[k.start:k.end], len(term.text))
+				}
+			}
+		}
+
+		if at < 0 && term.words == nil && term.text != "" {
+			if i := strings.LastIndex(folded, term.text); i >= 0 {
+				best, start, end = 1, spans[i][0], spans[i+len(term.text)-1][1]
+				if start < base {
+					best /= 4
+				}
+			}
+		}
+
+		if best == 0 {
+			prev = -2
+			continue
+		}
+		if at >= 0 && at == prev+1 {
+			score++
+		}
+		prev = at
+
+		score += best
+		ranges = append(ranges, [2]int{utf16Len(name[:start]), utf16Len(name[:end])})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	// Merge overlapping ranges
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return score, merged
+}
+
+// resolve the similar words of every term in q
+func (fs *CachedFS) resolve(ctx context.Context, q Query) error {
+	var err error
+	walkWords(q, true, func(w *queryWord) {
+		for i := range w.terms {
+			if err != nil || w.terms[i].phrase {
+				continue
+			}
+			w.terms[i].words, _, err = fs.similar(ctx, w.terms[i].text)
+		}
+	})
+	return err
+}
+
+// search returns the entries in the directories matching glob p that match q, best matches first.
+// If fuzzy is set, every word of q matches the words of a name within an edit distance threshold.
+func (fs *CachedFS) search(ctx context.Context, p string, trim int, q Query, fuzzy bool) (Files, error) {
+	if fuzzy {
+		if err := fs.resolve(ctx, q); err != nil {
+			return nil, err
+		}
+	}
+
+	terms := rankTerms(q)
+	res, err := fs.find(ctx, p, trim, q, terms, false)
+	if err != nil || len(res) > 0 || len(terms) == 0 || fuzzy {
+		return res, err
+	}
+
+	// No token matches, fall back to substrings
+	return fs.find(ctx, p, trim, q, terms, true)
+}
+
+// find returns the entries in the directories matching glob p that match q, ranked by terms.
+// If substr is set, words match substrings of the name rather than its tokens.
+func (fs *CachedFS) find(ctx context.Context, p string, trim int, q Query, terms []term, substr bool) (Files, error) {
+	where, args := compileQuery(q, substr)
+
+	// Names that match the most terms first, in case there are too many candidates
+	order := ""
+	c := queryCompiler{substr: substr}
+	for i := range terms {
+		order += " + (" + terms[i].where(&c) + ")"
+	}
+	if order != "" {
+		order = " ORDER BY " + order[3:] + " DESC"
+	}
+
+	rows, err := fs.db.QueryContext(ctx, "SELECT dirs.path, files.name, files.dir FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.root IN (SELECT rowid FROM dirs WHERE path GLOB ?) AND "+where+order+" LIMIT ?", append(append(append([]interface{}{p}, args...), c.args...), searchCandidates)...)
+	if err != nil {
+		return nil, err
+	}
+	return ranked(rows, trim, terms)
+}
+
+// Maximum number of "did you mean" suggestions
+const suggestions = 3
+
+// suggest returns up to three corrections of the words in query q (as parsed in n), replacing
+// them by the most similar (and most common) indexed words
+func (fs *CachedFS) suggest(ctx context.Context, q string, n Query) ([]string, error) {
+	cnt, err := fs.db.PrepareContext(ctx, "SELECT COUNT(*) FROM tokens WHERE token = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer cnt.Close()
+
+	var terms []term
+	walkWords(n, false, func(w *queryWord) {
+		if !w.phrase {
+			terms = append(terms, w.terms...)
+		}
+	})
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].pos < terms[j].pos })
+
+	alts := make([][]string, len(terms))
+	for i, t := range terms {
+		sim, words, err := fs.similar(ctx, t.text)
+		if err != nil {
+			return nil, err
+		}
+
+		freq := map[string]int64{}
+		alt := words[:0]
+		for _, w := range words {
+			var n int64
+			if err := cnt.QueryRowContext(ctx, w).Scan(&n); err != nil {
+				return nil, err
+			} else if n > 0 {
+				freq[w] = n
+				alt = append(alt, w)
+			}
+		}
+		sort.SliceStable(alt, func(i, j int) bool {
+			if sim[alt[i]] != sim[alt[j]] {
+				return sim[alt[i]] > sim[alt[j]]
+			}
+			return freq[alt[i]] > freq[alt[j]]
+		})
+		if len(alt) == 0 {
+			alt = append(alt, t.text)
+		}
+		alts[i] = alt
+	}
+
+	res := []string{}
+	seen := map[string]bool{fold(q): true}
+	for k := 0; k < suggestions; k++ {
+		var b strings.Builder
+		last := 0
+		for i, t := range terms {
+			a := alts[i][0]
+			if k < len(alts[i]) {
+				a = alts[i][k]
+			}
+			b.WriteString(q[last:t.pos])
+			b.WriteString(a)
+			last = t.pos + tokenize(q[t.pos:])[0].end
+		}
+		b.WriteString(q[last:])
+
+		if s := b.String(); !seen[fold(s)] {
+			seen[fold(s)] = true
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// ranked reads the (root, name, dir) rows of a search and orders them by relevance
+func ranked(rows *sql.Rows, trim int, terms []term) (Files, error) {
+	res, err := readFiles(rows, trim)
+	if err != nil {
+		return nil, err
+	}
+	return rankFiles(res, terms), nil
+}
+
+// rankFiles orders res by relevance to terms (best matches first), keeping the first searchResults
+func rankFiles(res Files, terms []term) Files {
+	if len(terms) == 0 {
+		sort.Sort(res)
+	}
+	for i := range res {
+		res[i].Score, res[i].Matches = rank(res[i].Name, terms)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		if li, lj := utf8.RuneCountInString(res[i].Name), utf8.RuneCountInString(res[j].Name); li != lj {
+			return li < lj
+		}
+		return res.Less(i, j)
+	})
+
+	if len(res) > searchResults {
+		res = res[:searchResults]
+	}
+	return res
+}
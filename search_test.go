@@ -0,0 +1,131 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	fs, root := newTestFS(t, "ubuntu/22.04/ubuntu-22.04-live-server-amd64.iso", "ubuntu/22.04/ubuntu-22.04-desktop-amd64.iso", "server.txt", "SHA256SUMS")
+	fill(t, fs)
+
+	search := func(q string, fuzzy bool) Files {
+		t.Helper()
+		n, err := parseQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := fs.search(context.Background(), "/*", 1, n, fuzzy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := search("ubuntu 22.04 server", false)
+	if len(res) != 1 || res[0].Name != "ubuntu/22.04/ubuntu-22.04-live-server-amd64.iso" {
+		t.Fatalf("Unexpected results %+v\n", res)
+	}
+	if m := res[0].Matches; len(m) != 4 || m[0] != [2]int{13, 19} || m[3] != [2]int{31, 37} {
+		t.Errorf("Unexpected matches %v\n", m)
+	}
+
+	if res := search("server", false); len(res) != 2 || res[0].Name != "server.txt" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("sums", false); len(res) != 1 || res[0].Matches[0] != [2]int{6, 10} {
+		t.Errorf("Unexpected substring results %+v\n", res)
+	}
+
+	if res := search("ubunut 22.04 servr", false); len(res) != 0 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("ubunut 22.04 servr", true); len(res) != 1 || res[0].Matches[0] != [2]int{13, 19} {
+		t.Errorf("Unexpected fuzzy results %+v\n", res)
+	}
+	if n, _ := parseQuery("Ubunut 22.04 -ext:txt"); n == nil {
+		t.Fatal("Empty query")
+	} else if alts, err := fs.suggest(context.Background(), "Ubunut 22.04 -ext:txt", n); err != nil || len(alts) != 1 || alts[0] != "ubuntu 22.04 -ext:txt" {
+		t.Errorf("Unexpected suggestions %v (%v)\n", alts, err)
+	}
+
+	for q, n := range map[string]int{
+		"ext:iso":                       2,
+		"ext:ISO,txt -desktop":          2,
+		"type:d":                        2,
+		"\"live-server\" OR sha256sums": 2,
+		"path:/ubuntu/ -type:d":         2,
+		"path:/22.04":                   0,
+		"(desktop OR server) ext:iso":   2,
+		"size:<1 mtime:>1d":             4,
+		"size:0 mtime:2000..":           4,
+		"size:>=1k OR mtime:..2000-02":  0,
+	} {
+		if res := search(q, false); len(res) != n {
+			t.Errorf("%s: Unexpected results %+v\n", q, res)
+		}
+	}
+
+	for q, n := range map[string]int{
+		"glob:*-amd64.iso":            2,
+		"glob:/ubuntu/*/SHA*":         0,
+		"glob:/*SUMS":                 1,
+		"regex:^ubuntu-[0-9.]+-live-": 1,
+		"regex:(?i)sums$":             1,
+	} {
+		i := strings.IndexByte(q, ':')
+		p, err := parseSearch(q[i+1:], q[:i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := fs.search(context.Background(), "/*", 1, p, false); err != nil || len(res) != n {
+			t.Errorf("%s: Unexpected results %+v (%v)\n", q, res, err)
+		}
+	}
+
+	// Tokens follow partial refreshes
+	if err := os.Rename(filepath.Join(root, "server.txt"), filepath.Join(root, "ubuntu", "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FillPath("/server.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FillPath("/ubuntu/notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := search("server", false); len(res) != 1 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+	if res := search("notes", false); len(res) != 1 || res[0].Name != "ubuntu/notes.txt" {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+
+	var n int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM tokens WHERE file NOT IN (SELECT rowid FROM files)").Scan(&n); err != nil || n != 0 {
+		t.Errorf("%d stale tokens (%v)\n", n, err)
+	}
+
+	// Decomposed names match composed searches, without case or accents
+	if err := os.WriteFile(filepath.Join(root, "Cafe\u0301 ÉLAN.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.FillPath("/Cafe\u0301 ÉLAN.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{"café élan", "CAFE elan"} {
+		if res := search(q, false); len(res) != 1 || len(res[0].Matches) != 2 || res[0].Matches[0] != [2]int{0, 5} {
+			t.Errorf("%s: Unexpected results %+v\n", q, res)
+		}
+	}
+	if res := search("path:\"é ela\"", false); len(res) != 1 {
+		t.Errorf("Unexpected results %+v\n", res)
+	}
+}
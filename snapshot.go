@@ -0,0 +1,289 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version of the snapshot format, incremented on incompatible changes
+const snapshotVersion = 1
+
+// SnapshotHeader is the first record of a snapshot or delta
+type SnapshotHeader struct {
+	Version int   `json:"version"`
+	Gen     int64 `json:"gen"`
+	Since   int64 `json:"since,omitempty"`
+	Time    int64 `json:"time"`
+}
+
+// Entry in a snapshot
+type Entry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mtime int64  `json:"mtime"`
+}
+
+// entries calls f for every entry in the index, read from db
+func (fs *CachedFS) entries(ctx context.Context, db queryer, f func(e *Entry) error) error {
+	rows, err := db.QueryContext(ctx, "SELECT dirs.path, files.name, files.dir, files.size, files.mtime FROM files JOIN dirs ON files.root = dirs.rowid")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var root string
+		var dir bool
+		var size, mtime sql.NullInt64
+		var e Entry
+		if err := rows.Scan(&root, &e.Name, &dir, &size, &mtime); err != nil {
+			return err
+		}
+
+		e.Name = root + e.Name
+		e.Size = size.Int64
+		e.Mtime = mtime.Int64
+		if dir {
+			e.Type = "d"
+		} else {
+			e.Type = "f"
+		}
+
+		if err := f(&e); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// writeEntries writes every entry in the index (read from db) as newline-delimited JSON
+func (fs *CachedFS) writeEntries(ctx context.Context, db queryer, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return fs.entries(ctx, db, func(e *Entry) error { return enc.Encode(e) })
+}
+
+// Snapshots of the index, regenerated after every refresh (re-read directories are left to the delta)
+type Snapshots struct {
+	fs   *CachedFS
+	mut  sync.Mutex
+	gen  int64
+	want int64
+	time time.Time
+	file string
+}
+
+// NewSnapshots for fs
+func NewSnapshots(fs *CachedFS) *Snapshots {
+	s := Snapshots{fs: fs, want: fs.Generation()}
+	fs.OnPublish(func(gen int64) {
+		atomic.StoreInt64(&s.want, gen)
+	})
+	return &s
+}
+
+// Close removes the last generated snapshot
+func (s *Snapshots) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.file == "" {
+		return nil
+	}
+
+	err := os.Remove(s.file)
+	s.file = ""
+	return err
+}
+
+// generate writes a compressed snapshot of the current generation to a temporary file
+func (s *Snapshots) generate(ctx context.Context) (string, int64, error) {
+	// A single read transaction sees the generation and its entries, without blocking refreshes
+	tx, err := s.fs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tx.Rollback()
+
+	var gen int64
+	if err := tx.QueryRowContext(ctx, "SELECT IFNULL(MAX(gen), 0) FROM generations").Scan(&gen); err != nil {
+		return "", 0, err
+	}
+
+	f, err := os.CreateTemp("", "autoindex-snapshot-*.ndjson.gz")
+	if err != nil {
+		return "", 0, err
+	}
+
+	b := bufio.NewWriter(f)
+	z := gzip.NewWriter(b)
+	err = json.NewEncoder(z).Encode(&SnapshotHeader{Version: snapshotVersion, Gen: gen, Time: time.Now().Unix()})
+	if err == nil {
+		err = s.fs.writeEntries(ctx, tx, z)
+	}
+	if err == nil {
+		err = z.Close()
+	}
+	if err == nil {
+		err = b.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", 0, err
+	}
+
+	return f.Name(), gen, nil
+}
+
+// open the snapshot of the last refresh, generating it if necessary
+func (s *Snapshots) open(ctx context.Context) (*os.File, int64, time.Time, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.file == "" || s.gen < atomic.LoadInt64(&s.want) {
+		name, gen, err := s.generate(ctx)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+		// Readers of the previous snapshot keep their open handle
+		if s.file != "" {
+			os.Remove(s.file)
+		}
+		s.file = name
+		s.gen = gen
+		s.time = time.Now()
+	}
+
+	f, err := os.Open(s.file)
+	return f, s.gen, s.time, err
+}
+
+// serveSnapshot serves the compressed snapshot of the last refresh
+func (s *Snapshots) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	f, gen, mod, err := s.open(r.Context())
+	if err != nil {
+		if r.Context().Err() == nil {
+			logError(http.StatusInternalServerError, err, w, r)
+		}
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"autoindex-%d.ndjson.gz\"", gen))
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("ETag", fmt.Sprintf("\"%d-%d\"", snapshotVersion, gen))
+	http.ServeContent(w, r, "", mod, f)
+}
+
+// hasDelta reports whether all changes between generation since and gen are logged
+func (fs *CachedFS) hasDelta(ctx context.Context, since int64, gen int64) (bool, error) {
+	if since > gen || since < 0 {
+		return false, nil
+	}
+	if since == gen {
+		return true, nil
+	}
+
+	var next, untracked int
+	if err := fs.db.QueryRowContext(ctx, "SELECT (SELECT COUNT(*) FROM generations WHERE gen = ? + 1), (SELECT COUNT(*) FROM generations WHERE gen > ? AND added IS NULL)", since, since).Scan(&next, &untracked); err != nil {
+		return false, err
+	}
+
+	return next > 0 && untracked == 0, nil
+}
+
+// serveDelta serves the changes after generation since as newline-delimited JSON,
+// or 410 Gone if the client has to download a new snapshot
+func (s *Snapshots) serveDelta(w http.ResponseWriter, r *http.Request, since int64) {
+	fs := s.fs
+	gen := fs.Generation()
+
+	ok, err := fs.hasDelta(r.Context(), since, gen)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	if !ok {
+		http.Error(w, "410 Gone", http.StatusGone)
+		return
+	}
+
+	// Changes of generations published after gen are left for the next delta
+	rows, err := fs.db.QueryContext(r.Context(), "SELECT rowid, gen, time, root, name, dir, op, size, mtime FROM changes WHERE gen > ? AND gen <= ? ORDER BY rowid", since, gen)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	defer rows.Close()
+
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		z := gzip.NewWriter(w)
+		defer z.Close()
+		out = z
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "max-age=60")
+	w.Header().Set("Vary", "Accept-Encoding")
+
+	enc := json.NewEncoder(out)
+	enc.Encode(&SnapshotHeader{Version: snapshotVersion, Gen: gen, Since: since, Time: time.Now().Unix()})
+
+	for rows.Next() {
+		c, err := scanChange(rows, 0)
+		if err != nil {
+			logErr.Printf("Snapshot: %s\n", err.Error())
+			return
+		}
+		if err := enc.Encode(&c); err != nil {
+			return
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logErr.Printf("Snapshot: %s\n", err.Error())
+	}
+}
+
+// ServeHTTP serves the snapshot of the last refresh, or the delta since generation "since"
+func (s *Snapshots) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		s.serveDelta(w, r, since)
+		return
+	}
+
+	s.serveSnapshot(w, r)
+}
@@ -0,0 +1,127 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshots(t *testing.T) {
+	fs, root := newTestFS(t, "dir/")
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		if err := os.WriteFile(filepath.Join(root, filepath.FromSlash(name)), []byte("abc"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Retention = time.Hour
+
+	s := NewSnapshots(fs)
+	defer s.Close()
+
+	fill(t, fs)
+	first := fs.Generation()
+
+	get := func(u string, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != status {
+			t.Fatalf("%s: Expected status %d, got %d\n", u, status, w.Code)
+		}
+		return w
+	}
+
+	// Full snapshot
+	w := get("/", http.StatusOK)
+	z, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(z)
+	var hdr SnapshotHeader
+	if err := dec.Decode(&hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != snapshotVersion || hdr.Gen != first || hdr.Since != 0 {
+		t.Fatalf("Unexpected header %+v\n", hdr)
+	}
+	entries := map[string]Entry{}
+	for dec.More() {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		entries[e.Name] = e
+	}
+	if len(entries) != 3 || entries["/dir"].Type != "d" || entries["/a.txt"].Size != 3 || entries["/dir/b.txt"].Type != "f" {
+		t.Fatalf("Unexpected entries %+v\n", entries)
+	}
+	if etag := w.Header().Get("ETag"); etag != "\"1-"+strconv.FormatInt(first, 10)+"\"" {
+		t.Fatalf("Unexpected ETag %q\n", etag)
+	}
+
+	// Delta
+	os.Remove(filepath.Join(root, "a.txt"))
+	os.WriteFile(filepath.Join(root, "c.txt"), nil, 0644)
+	fill(t, fs)
+	gen := fs.Generation()
+
+	w = get("/?since="+strconv.FormatInt(first, 10), http.StatusOK)
+	sc := bufio.NewScanner(w.Body)
+	if !sc.Scan() {
+		t.Fatal("Expected header")
+	}
+	if err := json.Unmarshal(sc.Bytes(), &hdr); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Gen != gen || hdr.Since != first {
+		t.Fatalf("Unexpected header %+v\n", hdr)
+	}
+	ops := map[string]string{}
+	for sc.Scan() {
+		var c Change
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		ops[c.Name] = c.Op
+	}
+	if len(ops) != 2 || ops["/a.txt"] != "removed" || ops["/c.txt"] != "added" {
+		t.Fatalf("Unexpected changes %+v\n", ops)
+	}
+
+	// Up to date
+	w = get("/?since="+strconv.FormatInt(gen, 10), http.StatusOK)
+	lines := 0
+	for sc = bufio.NewScanner(w.Body); sc.Scan(); {
+		lines++
+	}
+	if lines != 1 {
+		t.Fatalf("Expected header only, got %d lines\n", lines)
+	}
+
+	// Clients have to fall back to a full snapshot if the log does not cover their generation
+	get("/?since=0", http.StatusGone)
+	get("/?since="+strconv.FormatInt(gen+1, 10), http.StatusGone)
+	get("/?since=-1", http.StatusGone)
+	get("/?since=invalid", http.StatusBadRequest)
+
+	// A new generation replaces the snapshot
+	w = get("/", http.StatusOK)
+	if z, err = gzip.NewReader(w.Body); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(z).Decode(&hdr); err != nil || hdr.Gen != gen {
+		t.Fatalf("Expected snapshot of generation %d, got %+v (%v)\n", gen, hdr, err)
+	}
+}
@@ -0,0 +1,196 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Default and maximum number of completions
+const (
+	completionsDefault = 10
+	completionsMax     = 50
+)
+
+// Maximum number of candidates that are ordered for completions
+const completionCandidates = 1000
+
+// completions returns up to n entries in subtree dir whose name starts with prefix q (folded), followed by
+// entries with a word that starts with it. If q contains a slash, it completes a path relative to dir instead.
+func (fs *CachedFS) completions(ctx context.Context, dir string, q string, n int) (Files, error) {
+	prefix := escapeGlob(fold(q)) + "*"
+	order := " ORDER BY files.dir DESC, LENGTH(files.name), files.name LIMIT ?"
+
+	var phases []string
+	var args [][]interface{}
+	if i := strings.LastIndexByte(q, '/'); i >= 0 {
+		p := cleanPath(dir + q[:i+1])
+		if !strings.HasPrefix(p, dir) {
+			return Files{}, nil
+		}
+		prefix = escapeGlob(fold(q[i+1:])) + "*"
+		// Folded paths of directories outside dir (e.g. /e/ for /é/) can match as well
+		phases = append(phases, "SELECT dirs.path, files.name, files.dir FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.rowid IN (SELECT files.rowid FROM files JOIN dirs ON files.root = dirs.rowid WHERE dirs.search = ? AND dirs.path GLOB ? AND files.search GLOB ? LIMIT ?)"+order)
+		args = append(args, []interface{}{fold(p), escapeGlob(dir) + "*", prefix, completionCandidates, n})
+	} else {
+		sub := escapeGlob(dir) + "*"
+		phases = append(phases,
+			"SELECT dirs.path, files.name, files.dir FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.rowid IN (SELECT rowid FROM files WHERE search GLOB ? AND root IN (SELECT rowid FROM dirs WHERE path GLOB ?) LIMIT ?)"+order,
+			"SELECT dirs.path, files.name, files.dir FROM files JOIN dirs ON files.root = dirs.rowid WHERE files.rowid IN (SELECT file FROM tokens JOIN files ON files.rowid = tokens.file WHERE tokens.token GLOB ? AND files.root IN (SELECT rowid FROM dirs WHERE path GLOB ?) LIMIT ?)"+order,
+		)
+		args = append(args, []interface{}{prefix, sub, completionCandidates, n}, []interface{}{prefix, sub, completionCandidates, n})
+	}
+
+	res := make(Files, 0, n)
+	seen := map[string]bool{}
+	for i, p := range phases {
+		rows, err := fs.db.QueryContext(ctx, p, args[i]...)
+		if err != nil {
+			return nil, err
+		}
+		f, err := readFiles(rows, len(dir))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, x := range f {
+			if len(res) < n && !seen[x.Name] {
+				seen[x.Name] = true
+				res = append(res, x)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Suggest serves up to n (default 10) completions of prefix q in a subtree, as OpenSearch suggestions
+func (fs *CachedFS) Suggest(w http.ResponseWriter, r *http.Request) {
+	if !fs.DBReady() {
+		http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), fs.Timeout)
+	defer cancel()
+
+	n := completionsDefault
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "400 Bad Request", http.StatusBadRequest)
+			return
+		}
+		if n > completionsMax {
+			n = completionsMax
+		}
+	}
+
+	base, err := url.Parse("https://" + r.Host)
+	if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+	link := func(p string) string {
+		u := *base
+		u.Path = p
+		return u.String()
+	}
+
+	dir := cleanPath(r.URL.Path)
+	q := r.URL.Query().Get("q")
+
+	var id, ts int64
+	if err := fs.qd.QueryRowContext(ctx, escapeGlob(dir)).Scan(&id, &ts); err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		logError(http.StatusInternalServerError, err, w, r)
+		return
+	}
+
+	res := Files{}
+	if strings.TrimSpace(q) != "" {
+		if res, err = fs.completions(ctx, dir, q, n); err != nil {
+			logError(http.StatusInternalServerError, err, w, r)
+			return
+		}
+	}
+
+	// [query, completions, descriptions, urls]
+	names := make([]string, len(res))
+	descs := make([]string, len(res))
+	urls := make([]string, len(res))
+	for i, f := range res {
+		names[i] = f.Name
+		if f.Type == "d" {
+			names[i] += "/"
+			descs[i] = "Directory"
+			urls[i] = link(dir + names[i])
+		} else {
+			descs[i] = "File"
+			urls[i] = link("/dl" + dir + f.Name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-suggestions+json; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=60")
+	json.NewEncoder(w).Encode([]interface{}{q, names, descs, urls})
+}
+
+// OpenSearch description document (https://github.com/dewitt/opensearch)
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	Image         openSearchImage `xml:"Image"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+type openSearchImage struct {
+	Width  int    `xml:"width,attr"`
+	Height int    `xml:"height,attr"`
+	Type   string `xml:"type,attr"`
+	URL    string `xml:",chardata"`
+}
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Rel      string `xml:"rel,attr,omitempty"`
+	Template string `xml:"template,attr"`
+}
+
+// OpenSearch serves a description document, so browsers can add the (recursive) search as a search engine
+func OpenSearch(w http.ResponseWriter, r *http.Request) {
+	base := "https://" + r.Host
+	name := r.Host
+	if len(name) > 16 {
+		name = name[:16]
+	}
+
+	doc := openSearchDescription{
+		ShortName:     name,
+		Description:   "Search files on " + r.Host,
+		InputEncoding: "UTF-8",
+		Image:         openSearchImage{Width: 16, Height: 16, Type: "image/x-icon", URL: base + "/favicon.ico"},
+		URLs: []openSearchURL{
+			{Type: "text/html", Template: base + "/?r=1&q={searchTerms}"},
+			{Type: "application/x-suggestions+json", Template: base + "/suggest/?q={searchTerms}"},
+			{Type: "application/opensearchdescription+xml", Rel: "self", Template: base + "/opensearch.xml"},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/opensearchdescription+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(&doc)
+}
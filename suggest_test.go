@@ -0,0 +1,52 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCompletions(t *testing.T) {
+	fs, _ := newTestFS(t, "Ubuntu/22.04/ubuntu-22.04-server.iso", "Ubuntu/22.04/ubuntu-22.04-desktop.iso", "ubuntu.txt", "Über.txt", "server-notes.txt", "é/a.txt", "e/b.txt", "Docs/x.txt", "docs/y.txt")
+	fill(t, fs)
+
+	for _, c := range []struct {
+		dir  string
+		q    string
+		n    int
+		want []string
+	}{
+		{"/", "ubu", 10, []string{"Ubuntu", "ubuntu.txt", "Ubuntu/22.04/ubuntu-22.04-server.iso", "Ubuntu/22.04/ubuntu-22.04-desktop.iso"}},
+		{"/", "ubu", 2, []string{"Ubuntu", "ubuntu.txt"}},
+		{"/", "server", 10, []string{"server-notes.txt", "Ubuntu/22.04/ubuntu-22.04-server.iso"}},
+		{"/", "uber", 10, []string{"Über.txt"}},
+		{"/", "ubuntu/22", 10, []string{"Ubuntu/22.04"}},
+		{"/", "UBUNTU/22.04/ubuntu-22.04-d", 10, []string{"Ubuntu/22.04/ubuntu-22.04-desktop.iso"}},
+		{"/Ubuntu/", "22.04/", 10, []string{"22.04/ubuntu-22.04-server.iso", "22.04/ubuntu-22.04-desktop.iso"}},
+		{"/Ubuntu/", "../", 10, nil},
+		{"/é/", "/", 10, []string{"a.txt"}},
+		{"/e/", "/", 10, []string{"b.txt"}},
+		{"/docs/", "/", 10, []string{"y.txt"}},
+		{"/Docs/", "/", 10, []string{"x.txt"}},
+		{"/", "DOCS/", 10, []string{"Docs/x.txt", "docs/y.txt"}},
+		{"/", "nothing", 10, nil},
+	} {
+		res, err := fs.completions(context.Background(), c.dir, c.q, c.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != len(c.want) {
+			t.Errorf("%s%s: Unexpected completions %+v\n", c.dir, c.q, res)
+			continue
+		}
+		for i := range res {
+			if res[i].Name != c.want[i] {
+				t.Errorf("%s%s: Unexpected completions %+v\n", c.dir, c.q, res)
+				break
+			}
+		}
+	}
+}
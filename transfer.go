@@ -0,0 +1,240 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var csvHeader = []string{"name", "type", "size", "mtime"}
+
+// check reports whether e is a valid entry for import
+func (e *Entry) check() error {
+	if e.Name == "" || e.Name[0] != '/' || e.Name == "/" || path.Clean(e.Name) != e.Name {
+		return fmt.Errorf("invalid path %q", e.Name)
+	}
+	if e.Type != "d" && e.Type != "f" {
+		return fmt.Errorf("invalid type %q for %q", e.Type, e.Name)
+	}
+	return nil
+}
+
+// Export writes the index to w as newline-delimited JSON (the snapshot format) or CSV
+func (fs *CachedFS) Export(ctx context.Context, w io.Writer, format string) error {
+	switch format {
+	case "ndjson":
+		if err := json.NewEncoder(w).Encode(&SnapshotHeader{Version: snapshotVersion, Gen: fs.Generation(), Time: time.Now().Unix()}); err != nil {
+			return err
+		}
+		return fs.writeEntries(ctx, fs.db, w)
+	case "csv":
+		c := csv.NewWriter(w)
+		if err := c.Write(csvHeader); err != nil {
+			return err
+		}
+		if err := fs.entries(ctx, fs.db, func(e *Entry) error {
+			return c.Write([]string{e.Name, e.Type, strconv.FormatInt(e.Size, 10), strconv.FormatInt(e.Mtime, 10)})
+		}); err != nil {
+			return err
+		}
+		c.Flush()
+		return c.Error()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// readEntries calls f for every entry read from r (optionally gzip-compressed)
+func readEntries(r io.Reader, format string, f func(e *Entry) error) error {
+	b := bufio.NewReader(r)
+	if m, err := b.Peek(2); err == nil && m[0] == 0x1f && m[1] == 0x8b {
+		z, err := gzip.NewReader(b)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		b = bufio.NewReader(z)
+	}
+
+	switch format {
+	case "ndjson":
+		s := bufio.NewScanner(b)
+		s.Buffer(make([]byte, 64*1024), 1024*1024)
+		for line := 1; s.Scan(); line++ {
+			if len(s.Bytes()) == 0 {
+				continue
+			}
+
+			var e struct {
+				Version int `json:"version"`
+				Entry
+			}
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+
+			// Header
+			if e.Version != 0 {
+				if e.Version > snapshotVersion {
+					return fmt.Errorf("line %d: unsupported version %d", line, e.Version)
+				}
+				continue
+			}
+
+			if err := f(&e.Entry); err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+		}
+		return s.Err()
+	case "csv":
+		c := csv.NewReader(b)
+		c.FieldsPerRecord = len(csvHeader)
+		c.ReuseRecord = true
+		for line := 1; ; line++ {
+			rec, err := c.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if line == 1 && rec[0] == csvHeader[0] {
+				continue
+			}
+
+			e := Entry{Name: rec[0], Type: rec[1]}
+			if e.Size, err = strconv.ParseInt(rec[2], 10, 64); err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			if e.Mtime, err = strconv.ParseInt(rec[3], 10, 64); err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+			if err := f(&e); err != nil {
+				return fmt.Errorf("line %d: %s", line, err.Error())
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// Import replaces the index by the entries read from r (see Export), publishing them as a new generation
+func (fs *CachedFS) Import(r io.Reader, format string) (int, error) {
+	if err := fs.lock(context.Background()); err != nil {
+		return 0, err
+	}
+	defer fs.unlock()
+
+	if err := fs.createTmp(); err != nil {
+		return 0, err
+	}
+
+	s := scanner{db: fs.db, batch: 16384}
+	if err := s.begin(); err != nil {
+		return 0, err
+	}
+
+	now := time.Now().Unix()
+	dirs := map[string]int64{}
+
+	// Directories that are not listed themselves, with the newest modification time in their subtree
+	implicit := map[string]int64{}
+
+	// Paths listed so far, an entry may not be listed twice
+	listed := map[string]bool{}
+
+	var dirID func(p string) (int64, error)
+	dirID = func(p string) (int64, error) {
+		if id, ok := dirs[p]; ok {
+			return id, nil
+		}
+		if p != "/" {
+			if _, err := dirID(parentDir(p)); err != nil {
+				return 0, err
+			}
+			implicit[p] = 0
+		}
+		row, err := s.idir.Exec(p, fold(p), now)
+		if err != nil {
+			return 0, err
+		}
+		id, err := row.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		dirs[p] = id
+		return id, nil
+	}
+
+	_, err := dirID("/")
+	if err == nil {
+		err = readEntries(r, format, func(e *Entry) error {
+			if err := e.check(); err != nil {
+				return err
+			}
+			if listed[e.Name] {
+				return fmt.Errorf("duplicate path %q", e.Name)
+			}
+			listed[e.Name] = true
+
+			root, name := path.Split(e.Name)
+			id, err := dirID(root)
+			if err != nil {
+				return err
+			}
+			for p := root; p != ""; p = parentDir(p) {
+				if mtime, ok := implicit[p]; ok && e.Mtime > mtime {
+					implicit[p] = e.Mtime
+				}
+			}
+			if e.Type == "d" {
+				if _, err := dirID(e.Name + "/"); err != nil {
+					return err
+				}
+				delete(implicit, e.Name+"/")
+			}
+
+			if _, err := s.ifile.Exec(id, name, fold(name), e.Type == "d", e.Size, e.Mtime); err != nil {
+				return err
+			}
+			return s.next()
+		})
+	}
+
+	// Add the entries of unlisted directories to their parents
+	for p, mtime := range implicit {
+		if err != nil {
+			break
+		}
+
+		root, name := path.Split(strings.TrimSuffix(p, "/"))
+		if _, err = s.ifile.Exec(dirs[root], name, fold(name), true, 0, mtime); err == nil {
+			err = s.next()
+		}
+	}
+	if err == nil {
+		err = fs.checkShrink(atomic.LoadInt64(&fs.dbn), int64(s.cnt))
+	}
+	if err != nil {
+		s.tx.Rollback()
+		return 0, err
+	}
+
+	if err := fs.swap(s.tx, s.cnt); err != nil {
+		return 0, err
+	}
+
+	return s.cnt + 1, nil
+}
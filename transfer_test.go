@@ -0,0 +1,97 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransfer(t *testing.T) {
+	src, root := newTestFS(t, "a/empty/")
+	if err := os.WriteFile(filepath.Join(root, "a", "b, \"c\".txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fill(t, src)
+
+	for _, format := range []string{"ndjson", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			var exp bytes.Buffer
+			if err := src.Export(context.Background(), &exp, format); err != nil {
+				t.Fatal(err)
+			}
+
+			dst, _ := newTestFS(t)
+			if n, err := dst.Import(bytes.NewReader(exp.Bytes()), format); err != nil || n != 4 {
+				t.Fatalf("Import returned %d (%v)\n", n, err)
+			}
+
+			// Header differs in time only, compare entries
+			var a, b bytes.Buffer
+			src.writeEntries(context.Background(), src.db, &a)
+			dst.writeEntries(context.Background(), dst.db, &b)
+			if a.String() != b.String() {
+				t.Errorf("Entries differ after import:\n%s\n%s\n", a.String(), b.String())
+			}
+
+			var id, ts int64
+			if err := dst.qd.QueryRow("/a/empty/").Scan(&id, &ts); err != nil {
+				t.Errorf("Expected empty directory: %v\n", err)
+			}
+		})
+	}
+
+	if _, err := src.Import(bytes.NewReader([]byte(`{"name":"/a/../b","type":"f"}`)), "ndjson"); err == nil {
+		t.Error("Expected error for invalid path")
+	}
+}
+
+func TestImportFiles(t *testing.T) {
+	fs, _ := newTestFS(t)
+
+	// Parent directories are not listed
+	in := `{"name":"/x/y/z.txt","type":"f","size":1,"mtime":100}
+{"name":"/x/w.txt","type":"f","size":2,"mtime":50}
+{"name":"/top.txt","type":"f","size":4,"mtime":10}
+`
+	if n, err := fs.Import(bytes.NewReader([]byte(in)), "ndjson"); err != nil || n != 6 {
+		t.Fatalf("Import returned %d (%v)\n", n, err)
+	}
+
+	ents := map[string]Entry{}
+	if err := fs.entries(context.Background(), fs.db, func(e *Entry) error {
+		ents[e.Name] = *e
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 5 || ents["/x"] != (Entry{Name: "/x", Type: "d", Mtime: 100}) || ents["/x/y"] != (Entry{Name: "/x/y", Type: "d", Mtime: 100}) {
+		t.Fatalf("Unexpected entries %+v\n", ents)
+	}
+
+	a, err := scanAggregate(fs.db.QueryRow("SELECT "+aggCols+" FROM dirs WHERE path = ?", "/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Files != 3 || a.Dirs != 2 || a.Size != 7 {
+		t.Fatalf("Unexpected aggregate %+v\n", a)
+	}
+
+	// Paths listed twice are refused, the index is kept
+	gen := fs.Generation()
+	in = `{"name":"/x","type":"d","size":0,"mtime":100}
+{"name":"/x/w.txt","type":"f","size":2,"mtime":50}
+{"name":"/x","type":"d","size":0,"mtime":100}
+`
+	if _, err := fs.Import(bytes.NewReader([]byte(in)), "ndjson"); err == nil {
+		t.Fatal("Expected duplicate path to be refused")
+	}
+	if fs.Generation() != gen {
+		t.Fatalf("Expected generation %d, got %d\n", gen, fs.Generation())
+	}
+}
@@ -0,0 +1,309 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook endpoint that is notified of changes
+type Webhook struct {
+	URL    string
+	Prefix string
+	Secret string
+}
+
+// Webhook list (flag.Value)
+type webhooks []Webhook
+
+func (w *webhooks) String() string {
+	var s []string
+	for _, v := range *w {
+		s = append(s, v.URL)
+	}
+	return strings.Join(s, ",")
+}
+
+// Set parses "url[,prefix=path][,secret=key]"
+func (w *webhooks) Set(s string) error {
+	f := strings.Split(s, ",")
+
+	u, err := url.Parse(f[0])
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("expected http(s) url")
+	}
+
+	h := Webhook{URL: f[0], Prefix: "/"}
+	for _, kv := range f[1:] {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return fmt.Errorf("expected key=value, got %q", kv)
+		}
+		switch kv[:i] {
+		case "prefix":
+			h.Prefix = cleanPath(kv[i+1:])
+		case "secret":
+			h.Secret = kv[i+1:]
+		default:
+			return fmt.Errorf("unknown webhook option %q", kv[:i])
+		}
+	}
+
+	*w = append(*w, h)
+	return nil
+}
+
+// id identifies the configuration of a webhook in the delivery queue, so that
+// entries for the same URL are told apart (and the secret is not stored)
+func (h *Webhook) id() string {
+	sum := sha256.Sum256([]byte(h.URL + "\x00" + h.Prefix + "\x00" + h.Secret))
+	return hex.EncodeToString(sum[:16])
+}
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	Gen      int64    `json:"gen"`
+	Time     int64    `json:"time"`
+	Prefix   string   `json:"prefix"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []string `json:"modified"`
+}
+
+// Maximum number of delivery attempts before a notification is dropped
+const webhookAttempts = 10
+
+// Notifier delivers change notifications to webhooks, using a persistent queue
+type Notifier struct {
+	fs     *CachedFS
+	hooks  []Webhook
+	wake   chan struct{}
+	Client *http.Client
+
+	// Delay before retrying a failed delivery, doubled after every attempt
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewNotifier for the given webhooks, enqueueing a notification whenever fs publishes changes
+func NewNotifier(fs *CachedFS, hooks []Webhook) (*Notifier, error) {
+	if _, err := fs.db.Exec("CREATE TABLE IF NOT EXISTS webhooks (hook TEXT, url TEXT, payload BLOB, attempts INTEGER, next INTEGER)"); err != nil {
+		return nil, err
+	}
+
+	n := Notifier{
+		fs:         fs,
+		hooks:      hooks,
+		wake:       make(chan struct{}, 1),
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		Backoff:    time.Minute,
+		MaxBackoff: time.Hour,
+	}
+
+	fs.OnPublish(func(gen int64) {
+		if err := n.enqueue(gen); err != nil {
+			logErr.Printf("Webhook: %s\n", err.Error())
+		}
+	})
+
+	return &n, nil
+}
+
+// enqueue notifications for the changes of generation gen
+func (n *Notifier) enqueue(gen int64) error {
+	changes, err := n.fs.changesOf(context.Background(), gen)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, h := range n.hooks {
+		p := WebhookPayload{
+			Gen:      gen,
+			Time:     now,
+			Prefix:   h.Prefix,
+			Added:    make([]string, 0),
+			Removed:  make([]string, 0),
+			Modified: make([]string, 0),
+		}
+
+		cnt := 0
+		for _, c := range changes {
+			if !strings.HasPrefix(c.Name, h.Prefix) {
+				continue
+			}
+
+			cnt++
+			switch c.Op {
+			case "added":
+				p.Added = append(p.Added, c.Name)
+			case "removed":
+				p.Removed = append(p.Removed, c.Name)
+			case "modified":
+				p.Modified = append(p.Modified, c.Name)
+			}
+		}
+		if cnt == 0 {
+			continue
+		}
+
+		b, err := json.Marshal(&p)
+		if err != nil {
+			return err
+		}
+		if _, err := n.fs.db.Exec("INSERT INTO webhooks (hook, url, payload, attempts, next) VALUES (?, ?, ?, 0, ?)", h.id(), h.URL, b, now); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 signature of body
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// hook looks up the configuration of the webhook with the given id
+func (n *Notifier) hook(id string) (Webhook, bool) {
+	for _, h := range n.hooks {
+		if h.id() == id {
+			return h, true
+		}
+	}
+	return Webhook{}, false
+}
+
+// deliver posts a notification to webhook h
+func (n *Notifier) deliver(ctx context.Context, id int64, h *Webhook, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("User-Agent", "autoindex")
+	req.Header.Set("X-Autoindex-Delivery", strconv.FormatInt(id, 10))
+	if h.Secret != "" {
+		req.Header.Set("X-Autoindex-Signature", sign(h.Secret, body))
+	}
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Flush attempts to deliver all notifications that are due.
+// Returns the time at which the next notification is due (zero if none).
+func (n *Notifier) Flush(ctx context.Context) (time.Time, error) {
+	for {
+		var id, attempts, next int64
+		var hid, u string
+		var body []byte
+
+		err := n.fs.db.QueryRowContext(ctx, "SELECT rowid, hook, url, payload, attempts, next FROM webhooks ORDER BY next, rowid LIMIT 1").Scan(&id, &hid, &u, &body, &attempts, &next)
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		} else if err != nil {
+			return time.Time{}, err
+		}
+
+		if due := time.Unix(next, 0); due.After(time.Now()) {
+			return due, nil
+		}
+
+		done := true
+		if h, ok := n.hook(hid); !ok {
+			logErr.Printf("Webhook: Dropping delivery %d to %s (no longer configured)\n", id, u)
+		} else if err := n.deliver(ctx, id, &h, body); err != nil {
+			attempts++
+			if attempts < webhookAttempts {
+				logErr.Printf("Webhook: Delivery %d to %s failed: %s\n", id, u, err.Error())
+				done = false
+			} else {
+				logErr.Printf("Webhook: Dropping delivery %d to %s after %d attempts: %s\n", id, u, attempts, err.Error())
+			}
+		}
+
+		if done {
+			if _, err := n.fs.db.ExecContext(ctx, "DELETE FROM webhooks WHERE rowid = ?", id); err != nil {
+				return time.Time{}, err
+			}
+			continue
+		}
+
+		b := n.Backoff
+		for i := int64(1); i < attempts && b < n.MaxBackoff; i++ {
+			b *= 2
+		}
+		if b > n.MaxBackoff {
+			b = n.MaxBackoff
+		}
+
+		if _, err := n.fs.db.ExecContext(ctx, "UPDATE webhooks SET attempts = ?, next = ? WHERE rowid = ?", attempts, time.Now().Add(b).Unix(), id); err != nil {
+			return time.Time{}, err
+		}
+	}
+}
+
+// Run delivers notifications until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		next, err := n.Flush(ctx)
+		if err != nil && ctx.Err() == nil {
+			logErr.Printf("Webhook: %s\n", err.Error())
+			next = time.Now().Add(n.Backoff)
+		}
+
+		var t *time.Timer
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			t = time.NewTimer(time.Until(next))
+			wait = t.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-n.wake:
+		case <-wait:
+		}
+
+		if t != nil {
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Author:  Niels A.D.
+// Project: autoindex (https://github.com/nielsAD/autoindex)
+// License: Mozilla Public License, v2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	fs, root := newTestFS(t, "pub/old", "tmp/")
+	fs.Retention = time.Hour
+
+	fail := true
+	payloads := make(chan []byte, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			fail = false
+			http.Error(w, "503 Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		b, _ := io.ReadAll(r.Body)
+		if s := r.Header.Get("X-Autoindex-Signature"); s != sign("secret", b) {
+			t.Errorf("Unexpected signature: %s\n", s)
+		}
+		payloads <- b
+	}))
+	defer srv.Close()
+
+	var hooks webhooks
+	if err := hooks.Set(srv.URL + ",prefix=pub,secret=secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := NewNotifier(fs, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Backoff = 0
+
+	fill(t, fs)
+
+	os.Remove(filepath.Join(root, "pub", "old"))
+	os.WriteFile(filepath.Join(root, "pub", "new"), nil, 0644)
+	os.WriteFile(filepath.Join(root, "tmp", "ignored"), nil, 0644)
+
+	fill(t, fs)
+
+	// First attempt fails, second one is delivered
+	for i := 0; i < 2; i++ {
+		if _, err := n.Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case b := <-payloads:
+		var p WebhookPayload
+		if err := json.Unmarshal(b, &p); err != nil {
+			t.Fatal(err)
+		}
+		expected := WebhookPayload{
+			Gen:      2,
+			Time:     p.Time,
+			Prefix:   "/pub/",
+			Added:    []string{"/pub/new"},
+			Removed:  []string{"/pub/old"},
+			Modified: []string{},
+		}
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("Unexpected payload: %s\n", b)
+		}
+	default:
+		t.Fatal("Expected webhook delivery")
+	}
+
+	var cnt int
+	if err := fs.db.QueryRow("SELECT COUNT(*) FROM webhooks").Scan(&cnt); err != nil || cnt != 0 {
+		t.Errorf("Unexpected delivery queue length: %d\n", cnt)
+	}
+}
+
+func TestWebhookSameURL(t *testing.T) {
+	fs, root := newTestFS(t, "pub/", "tmp/")
+	fs.Retention = time.Hour
+
+	secrets := map[string]string{"/pub/": "a", "/tmp/": "b"}
+	payloads := make(chan WebhookPayload, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var p WebhookPayload
+		if err := json.Unmarshal(b, &p); err != nil {
+			t.Error(err)
+		}
+		if s := r.Header.Get("X-Autoindex-Signature"); s != sign(secrets[p.Prefix], b) {
+			t.Errorf("%s: Unexpected signature: %s\n", p.Prefix, s)
+		}
+		payloads <- p
+	}))
+	defer srv.Close()
+
+	var hooks webhooks
+	for _, s := range []string{srv.URL + ",prefix=pub,secret=a", srv.URL + ",prefix=tmp,secret=b"} {
+		if err := hooks.Set(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := NewNotifier(fs, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(t, fs)
+	writeFiles(t, root, "pub/a", "tmp/b")
+	fill(t, fs)
+
+	if _, err := n.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(payloads)
+
+	got := map[string][]string{}
+	for p := range payloads {
+		got[p.Prefix] = p.Added
+	}
+	if !reflect.DeepEqual(got, map[string][]string{"/pub/": {"/pub/a"}, "/tmp/": {"/tmp/b"}}) {
+		t.Errorf("Unexpected deliveries %v\n", got)
+	}
+}